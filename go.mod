@@ -0,0 +1,8 @@
+module github.com/mpbart/gbemulator
+
+go 1.16
+
+require (
+	github.com/go-gl/gl v0.0.0-20211210172815-726fda9656d6
+	github.com/go-gl/glfw/v3.3/glfw v0.0.0-20221017161538-93cebf72946b
+)
@@ -0,0 +1,88 @@
+package gbemu
+
+import "fmt"
+
+const MAX_CALL_STACK_DEPTH int = 1024
+
+// The call stack is a best-effort shadow of the real stack. Games are free to
+// pop return addresses, push fake ones and reload SP, so frames are matched
+// against SP rather than assumed to be balanced by RET instructions: any frame
+// whose return address lives below the current stack pointer has been
+// discarded by the game and is dropped.
+
+type StackFrame struct {
+	CallSite      uint16 // PC of the CALL/RST or of the instruction that was interrupted
+	Target        uint16 // Address of the called function or interrupt vector
+	ReturnAddress uint16
+	SP            uint16 // SP after the return address was pushed
+	Bank          int
+	Interrupt     bool
+}
+
+type CallStack interface {
+	Push(StackFrame)
+	Return(uint16)
+	Frames(uint16) []StackFrame
+	Reset()
+}
+
+type callStack struct {
+	frames []StackFrame
+}
+
+var interruptVectorNames = map[uint16]string{
+	0x40: "VBlank",
+	0x48: "STAT",
+	0x50: "Timer",
+	0x58: "Serial",
+	0x60: "Joypad",
+}
+
+func CreateCallStack() CallStack {
+	return &callStack{
+		frames: make([]StackFrame, 0, 64),
+	}
+}
+
+func (s *callStack) Push(frame StackFrame) {
+	// Frames at or below the new one can't still be live, the game must have
+	// moved SP back up without returning through them
+	s.discardBelow(frame.SP + 1)
+	if len(s.frames) == MAX_CALL_STACK_DEPTH {
+		s.frames = append(s.frames[:0], s.frames[1:]...)
+	}
+	s.frames = append(s.frames, frame)
+}
+
+// Return is called after a RET/RETI with the updated stack pointer
+func (s *callStack) Return(sp uint16) {
+	s.discardBelow(sp)
+}
+
+// Frames returns the live frames, outermost first. The returned slice is only
+// valid until the next call into the call stack and must not be modified.
+func (s *callStack) Frames(sp uint16) []StackFrame {
+	s.discardBelow(sp)
+	return s.frames
+}
+
+func (s *callStack) Reset() {
+	s.frames = s.frames[:0]
+}
+
+func (s *callStack) discardBelow(sp uint16) {
+	for len(s.frames) > 0 && s.frames[len(s.frames)-1].SP < sp {
+		s.frames = s.frames[:len(s.frames)-1]
+	}
+}
+
+func (f StackFrame) Describe(symbols SymbolTable) string {
+	target := fmt.Sprintf("%04X", f.Target)
+	if label := symbols.Symbolize(f.Bank, f.Target); label != "" {
+		target = fmt.Sprintf("%04X %s", f.Target, label)
+	}
+	if f.Interrupt {
+		return fmt.Sprintf("%s [%s interrupt, returns to %04X]", target, interruptVectorNames[f.Target], f.ReturnAddress)
+	}
+	return fmt.Sprintf("%s [called from %04X, returns to %04X]", target, f.CallSite, f.ReturnAddress)
+}
@@ -0,0 +1,102 @@
+package gbemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// A CDL (code/data log) file has one byte per ROM byte recording how the
+// game used it while running:
+//
+//	bit 0 - executed as the first byte of an instruction
+//	bit 1 - read as an instruction operand
+//	bit 2 - read as data
+//	bit 3 - used as an OAM DMA source
+//	bit 4 - copied into VRAM and later fetched by the PPU as tile data
+//
+// Logs are cumulative, an existing file for the same ROM is merged into.
+const (
+	CDL_CODE    uint8 = 0x01
+	CDL_OPERAND uint8 = 0x02
+	CDL_DATA    uint8 = 0x04
+	CDL_DMA     uint8 = 0x08
+	CDL_TILE    uint8 = 0x10
+)
+
+type CodeDataLogger interface {
+	Log(int, uint8)
+	Flags() []uint8
+	Write(string) error
+}
+
+type codeDataLogger struct {
+	flags []uint8
+}
+
+func CreateCodeDataLogger(romSize int) CodeDataLogger {
+	return &codeDataLogger{
+		flags: make([]uint8, romSize),
+	}
+}
+
+// LoadCodeDataLog reads a previously written CDL file. A log for a ROM of a
+// different size is rejected since its offsets would be meaningless.
+func LoadCodeDataLog(filename string, romSize int) (CodeDataLogger, error) {
+	flags, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR opening CDL file: %s", err)
+	}
+	if len(flags) != romSize {
+		return nil, fmt.Errorf("ERROR CDL file %s is %d bytes but the ROM is %d bytes", filename, len(flags), romSize)
+	}
+	return &codeDataLogger{flags: flags}, nil
+}
+
+// Log marks the ROM byte at the given offset (bank * 0x4000 + address within the bank)
+func (l *codeDataLogger) Log(offset int, flag uint8) {
+	if offset >= 0 && offset < len(l.flags) {
+		l.flags[offset] |= flag
+	}
+}
+
+func (l *codeDataLogger) Flags() []uint8 {
+	return l.flags
+}
+
+func (l *codeDataLogger) Write(filename string) error {
+	if err := ioutil.WriteFile(filename, l.flags, 0644); err != nil {
+		return fmt.Errorf("ERROR writing CDL file: %s", err)
+	}
+	return nil
+}
+
+// InitializeCodeDataLogger continues an existing log when there is one
+func InitializeCodeDataLogger(filename string, romSize int) CodeDataLogger {
+	if _, err := os.Stat(filename); err == nil {
+		logger, err := LoadCodeDataLog(filename, romSize)
+		if err == nil {
+			return logger
+		}
+		fmt.Println(err)
+	}
+	return CreateCodeDataLogger(romSize)
+}
+
+// ROMOffset converts a CPU address in the ROM area into an offset in the ROM
+// file given the bank that is currently mapped into 0x4000 - 0x7FFF
+func ROMOffset(address uint16, bank int) int {
+	if address < 0x4000 {
+		return int(address)
+	}
+	return bank*0x4000 + int(address-0x4000)
+}
+
+// ROMAddress is the inverse of ROMOffset
+func ROMAddress(offset int) (int, uint16) {
+	bank := offset / 0x4000
+	if bank == 0 {
+		return 0, uint16(offset)
+	}
+	return bank, uint16(0x4000 + offset%0x4000)
+}
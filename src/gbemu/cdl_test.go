@@ -0,0 +1,31 @@
+package gbemu
+
+import "testing"
+
+func TestCodeDataLoggerTiles(t *testing.T) {
+	tests := []struct {
+		name string
+		read func(MMU)
+		want uint8
+	}{
+		{"not read back", func(m MMU) {}, CDL_DATA},
+		{"read back by the CPU", func(m MMU) { m.ReadAt(0x8000) }, CDL_DATA},
+		{"fetched by the PPU", func(m MMU) { m.ReadVideoMemory(0x8000) }, CDL_DATA | CDL_TILE},
+	}
+
+	for _, test := range tests {
+		rom := make([]byte, 0x8000)
+		rom[0x200] = 0x5A
+		m := CreateMMU()
+		m.InitRom(rom)
+		logger := CreateCodeDataLogger(len(rom))
+		m.SetCodeDataLogger(logger)
+
+		// Copy a byte from ROM to the tile data like a copy loop would
+		m.WriteByte(0x8000, m.ReadAt(0x0200))
+		test.read(m)
+		if got := logger.Flags()[0x200]; got != test.want {
+			t.Errorf("%s: ROM flags = %02X, want %02X", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-gl/glfw/v3.3/glfw"
+	"github.com/mpbart/gbemulator/src/gbemu"
+)
+
+// Bindings map keyboard keys and gamepad buttons/axes to the Game Boy buttons
+// and to emulator hotkeys. A bindings file has one action per line, any
+// number of inputs separated by commas, and # comments:
+//
+//	a            = key:Enter, gamepad:A
+//	up           = key:Up, gamepad:DpadUp, axis:LeftY-
+//	save_state_1 = key:Shift+F1
+//	deadzone     = 0.3
+//
+// key:<name> optionally prefixed by Shift+, Control+, Alt+ or Super+
+// gamepad:<button> uses the GLFW gamepad (Xbox style) layout
+// axis:<axis>+ or axis:<axis>- is pressed once the axis is further than the
+// deadzone from center in that direction (the Y axes are negative for up)
+//
+// Actions listed in the file replace their default inputs, all other actions
+// keep the defaults below. An action with no inputs ("pause =") is unbound.
+const DEFAULT_BINDINGS = `
+a             = key:Enter, gamepad:A
+b             = key:Backspace, gamepad:B
+select        = key:RightShift, gamepad:Back
+start         = key:RightControl, gamepad:Start
+right         = key:Right, gamepad:DpadRight, axis:LeftX+
+left          = key:Left, gamepad:DpadLeft, axis:LeftX-
+up            = key:Up, gamepad:DpadUp, axis:LeftY-
+down          = key:Down, gamepad:DpadDown, axis:LeftY+
+fast_forward  = key:Tab, axis:RightTrigger+
+slow_motion   = key:Backslash, axis:LeftTrigger+
+pause         = key:P
+frame_advance = key:N
+rewind        = key:R, gamepad:LeftBumper
+save_state_1  = key:Shift+F1
+save_state_2  = key:Shift+F2
+save_state_3  = key:Shift+F3
+save_state_4  = key:Shift+F4
+save_state_5  = key:Shift+F5
+save_state_6  = key:Shift+F6
+save_state_7  = key:Shift+F7
+save_state_8  = key:Shift+F8
+save_state_9  = key:Shift+F9
+load_state_1  = key:F1
+load_state_2  = key:F2
+load_state_3  = key:F3
+load_state_4  = key:F4
+load_state_5  = key:F5
+load_state_6  = key:F6
+load_state_7  = key:F7
+load_state_8  = key:F8
+load_state_9  = key:F9
+deadzone      = 0.3
+`
+
+const SAVE_STATE_SLOTS = 9
+
+// Actions 0-7 are the Game Boy buttons, the rest are emulator hotkeys
+type bindingAction int
+
+const (
+	ACTION_FAST_FORWARD bindingAction = bindingAction(gbemu.BUTTON_DOWN) + 1 + iota
+	ACTION_SLOW_MOTION
+	ACTION_PAUSE
+	ACTION_FRAME_ADVANCE
+	ACTION_REWIND
+	ACTION_SAVE_STATE_1
+	ACTION_LOAD_STATE_1 = ACTION_SAVE_STATE_1 + SAVE_STATE_SLOTS
+	ACTION_COUNT        = ACTION_LOAD_STATE_1 + SAVE_STATE_SLOTS
+)
+
+type inputKind int
+
+const (
+	INPUT_KEY inputKind = iota
+	INPUT_GAMEPAD_BUTTON
+	INPUT_GAMEPAD_AXIS
+)
+
+type inputBinding struct {
+	kind      inputKind
+	key       glfw.Key
+	modifiers glfw.ModifierKey
+	button    glfw.GamepadButton
+	axis      glfw.GamepadAxis
+	direction float32
+}
+
+type Bindings struct {
+	actions  [ACTION_COUNT][]inputBinding
+	deadzone float32
+}
+
+var actionNames = func() map[string]bindingAction {
+	names := map[string]bindingAction{
+		"fast_forward":  ACTION_FAST_FORWARD,
+		"slow_motion":   ACTION_SLOW_MOTION,
+		"pause":         ACTION_PAUSE,
+		"frame_advance": ACTION_FRAME_ADVANCE,
+		"rewind":        ACTION_REWIND,
+	}
+	for b := gbemu.BUTTON_A; b <= gbemu.BUTTON_DOWN; b++ {
+		names[strings.ToLower(b.String())] = bindingAction(b)
+	}
+	for slot := 1; slot <= SAVE_STATE_SLOTS; slot++ {
+		names[fmt.Sprintf("save_state_%d", slot)] = ACTION_SAVE_STATE_1 + bindingAction(slot-1)
+		names[fmt.Sprintf("load_state_%d", slot)] = ACTION_LOAD_STATE_1 + bindingAction(slot-1)
+	}
+	return names
+}()
+
+var keyNames = func() map[string]glfw.Key {
+	names := map[string]glfw.Key{
+		"space": glfw.KeySpace, "apostrophe": glfw.KeyApostrophe, "comma": glfw.KeyComma,
+		"minus": glfw.KeyMinus, "period": glfw.KeyPeriod, "slash": glfw.KeySlash,
+		"semicolon": glfw.KeySemicolon, "equal": glfw.KeyEqual, "leftbracket": glfw.KeyLeftBracket,
+		"backslash": glfw.KeyBackslash, "rightbracket": glfw.KeyRightBracket, "graveaccent": glfw.KeyGraveAccent,
+		"escape": glfw.KeyEscape, "enter": glfw.KeyEnter, "tab": glfw.KeyTab, "backspace": glfw.KeyBackspace,
+		"insert": glfw.KeyInsert, "delete": glfw.KeyDelete, "right": glfw.KeyRight, "left": glfw.KeyLeft,
+		"down": glfw.KeyDown, "up": glfw.KeyUp, "pageup": glfw.KeyPageUp, "pagedown": glfw.KeyPageDown,
+		"home": glfw.KeyHome, "end": glfw.KeyEnd, "capslock": glfw.KeyCapsLock, "scrolllock": glfw.KeyScrollLock,
+		"numlock": glfw.KeyNumLock, "printscreen": glfw.KeyPrintScreen, "pause": glfw.KeyPause,
+		"leftshift": glfw.KeyLeftShift, "leftcontrol": glfw.KeyLeftControl, "leftalt": glfw.KeyLeftAlt,
+		"leftsuper": glfw.KeyLeftSuper, "rightshift": glfw.KeyRightShift, "rightcontrol": glfw.KeyRightControl,
+		"rightalt": glfw.KeyRightAlt, "rightsuper": glfw.KeyRightSuper, "menu": glfw.KeyMenu,
+	}
+	for i := 0; i < 26; i++ {
+		names[string(rune('a'+i))] = glfw.KeyA + glfw.Key(i)
+	}
+	for i := 0; i < 10; i++ {
+		names[strconv.Itoa(i)] = glfw.Key0 + glfw.Key(i)
+	}
+	for i := 0; i < 12; i++ {
+		names[fmt.Sprintf("f%d", i+1)] = glfw.KeyF1 + glfw.Key(i)
+	}
+	return names
+}()
+
+var modifierNames = map[string]glfw.ModifierKey{
+	"shift":   glfw.ModShift,
+	"control": glfw.ModControl,
+	"ctrl":    glfw.ModControl,
+	"alt":     glfw.ModAlt,
+	"super":   glfw.ModSuper,
+}
+
+var gamepadButtonNames = map[string]glfw.GamepadButton{
+	"a": glfw.ButtonA, "b": glfw.ButtonB, "x": glfw.ButtonX, "y": glfw.ButtonY,
+	"leftbumper": glfw.ButtonLeftBumper, "rightbumper": glfw.ButtonRightBumper,
+	"back": glfw.ButtonBack, "start": glfw.ButtonStart, "guide": glfw.ButtonGuide,
+	"leftthumb": glfw.ButtonLeftThumb, "rightthumb": glfw.ButtonRightThumb,
+	"dpadup": glfw.ButtonDpadUp, "dpadright": glfw.ButtonDpadRight,
+	"dpaddown": glfw.ButtonDpadDown, "dpadleft": glfw.ButtonDpadLeft,
+}
+
+var gamepadAxisNames = map[string]glfw.GamepadAxis{
+	"leftx": glfw.AxisLeftX, "lefty": glfw.AxisLeftY,
+	"rightx": glfw.AxisRightX, "righty": glfw.AxisRightY,
+	"lefttrigger": glfw.AxisLeftTrigger, "righttrigger": glfw.AxisRightTrigger,
+}
+
+func DefaultBindings() *Bindings {
+	bindings := &Bindings{}
+	if err := bindings.parse(strings.NewReader(DEFAULT_BINDINGS)); err != nil {
+		panic(err)
+	}
+	return bindings
+}
+
+// LoadBindings reads a bindings file on top of the defaults
+func LoadBindings(filename string) (*Bindings, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR opening bindings: %s", err)
+	}
+	defer f.Close()
+
+	bindings := DefaultBindings()
+	if err := bindings.parse(f); err != nil {
+		return nil, err
+	}
+	return bindings, nil
+}
+
+func (b *Bindings) parse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if comment := strings.Index(text, "#"); comment >= 0 {
+			text = text[:comment]
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(text, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("ERROR bindings line %d: expected <action> = <inputs>", line)
+		}
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+
+		if name == "deadzone" {
+			deadzone, err := strconv.ParseFloat(value, 32)
+			if err != nil || deadzone < 0 || deadzone >= 1 {
+				return fmt.Errorf("ERROR bindings line %d: deadzone has to be between 0 and 1", line)
+			}
+			b.deadzone = float32(deadzone)
+			continue
+		}
+
+		action, found := actionNames[name]
+		if !found {
+			return fmt.Errorf("ERROR bindings line %d: unknown action %q", line, name)
+		}
+		inputs := []inputBinding{}
+		for _, spec := range strings.Split(value, ",") {
+			if spec = strings.TrimSpace(spec); spec == "" {
+				continue
+			}
+			input, err := parseInputBinding(spec)
+			if err != nil {
+				return fmt.Errorf("ERROR bindings line %d: %s", line, err)
+			}
+			inputs = append(inputs, input)
+		}
+		b.actions[action] = inputs
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("ERROR reading bindings: %s", err)
+	}
+	return nil
+}
+
+func parseInputBinding(spec string) (inputBinding, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return inputBinding{}, fmt.Errorf("input %q has to be key:, gamepad: or axis:", spec)
+	}
+	name := strings.ToLower(strings.TrimSpace(parts[1]))
+
+	switch strings.ToLower(parts[0]) {
+	case "key":
+		input := inputBinding{kind: INPUT_KEY}
+		names := strings.Split(name, "+")
+		for _, modifier := range names[:len(names)-1] {
+			mod, found := modifierNames[modifier]
+			if !found {
+				return inputBinding{}, fmt.Errorf("unknown modifier %q", modifier)
+			}
+			input.modifiers |= mod
+		}
+		key, found := keyNames[names[len(names)-1]]
+		if !found {
+			return inputBinding{}, fmt.Errorf("unknown key %q", names[len(names)-1])
+		}
+		input.key = key
+		return input, nil
+	case "gamepad":
+		button, found := gamepadButtonNames[name]
+		if !found {
+			return inputBinding{}, fmt.Errorf("unknown gamepad button %q", name)
+		}
+		return inputBinding{kind: INPUT_GAMEPAD_BUTTON, button: button}, nil
+	case "axis":
+		input := inputBinding{kind: INPUT_GAMEPAD_AXIS}
+		if strings.HasSuffix(name, "+") {
+			input.direction = 1
+		} else if strings.HasSuffix(name, "-") {
+			input.direction = -1
+		} else {
+			return inputBinding{}, fmt.Errorf("axis %q needs a direction (+ or -)", name)
+		}
+		axis, found := gamepadAxisNames[name[:len(name)-1]]
+		if !found {
+			return inputBinding{}, fmt.Errorf("unknown gamepad axis %q", name[:len(name)-1])
+		}
+		input.axis = axis
+		return input, nil
+	}
+	return inputBinding{}, fmt.Errorf("input %q has to be key:, gamepad: or axis:", spec)
+}
+
+// inputState is what the frontend knows about the keyboard and gamepads
+// when the bindings are evaluated
+type inputState struct {
+	keys            map[glfw.Key]bool
+	modifiers       glfw.ModifierKey
+	hotkeyModifiers glfw.ModifierKey // Leaves out modifier keys bound to Game Boy buttons
+	gamepads        []*glfw.GamepadState
+}
+
+var modifierKeys = map[glfw.ModifierKey][]glfw.Key{
+	glfw.ModShift:   {glfw.KeyLeftShift, glfw.KeyRightShift},
+	glfw.ModControl: {glfw.KeyLeftControl, glfw.KeyRightControl},
+	glfw.ModAlt:     {glfw.KeyLeftAlt, glfw.KeyRightAlt},
+	glfw.ModSuper:   {glfw.KeyLeftSuper, glfw.KeyRightSuper},
+}
+
+// UpdateModifiers works out the held modifiers from the held keys. Select and
+// Start are on RightShift and RightControl by default, so those keys don't
+// count as modifiers for hotkeys while they're bound to a Game Boy button.
+func (b *Bindings) UpdateModifiers(state *inputState) {
+	state.modifiers = 0
+	state.hotkeyModifiers = 0
+	for modifier, keys := range modifierKeys {
+		for _, key := range keys {
+			if !state.keys[key] {
+				continue
+			}
+			state.modifiers |= modifier
+			if !b.boundToButton(key) {
+				state.hotkeyModifiers |= modifier
+			}
+		}
+	}
+}
+
+func (b *Bindings) boundToButton(key glfw.Key) bool {
+	for button := gbemu.BUTTON_A; button <= gbemu.BUTTON_DOWN; button++ {
+		for _, input := range b.actions[button] {
+			if input.kind == INPUT_KEY && input.key == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Active reports whether any input bound to the action is held. Game Boy
+// buttons ignore extra modifiers while hotkeys need exactly their modifiers
+// so F1 and Shift+F1 don't both fire.
+func (b *Bindings) Active(action bindingAction, state *inputState) bool {
+	for _, input := range b.actions[action] {
+		switch input.kind {
+		case INPUT_KEY:
+			if !state.keys[input.key] {
+				continue
+			}
+			if action <= bindingAction(gbemu.BUTTON_DOWN) {
+				if state.modifiers&input.modifiers == input.modifiers {
+					return true
+				}
+			} else if state.hotkeyModifiers == input.modifiers {
+				return true
+			}
+		case INPUT_GAMEPAD_BUTTON:
+			for _, gamepad := range state.gamepads {
+				if gamepad.Buttons[input.button] == glfw.Press {
+					return true
+				}
+			}
+		case INPUT_GAMEPAD_AXIS:
+			for _, gamepad := range state.gamepads {
+				if gamepad.Axes[input.axis]*input.direction > b.deadzone {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/go-gl/gl/v2.1/gl"
+	"github.com/go-gl/glfw/v3.3/glfw"
+	"github.com/mpbart/gbemulator/src/gbemu"
+)
+
+// The GLFW frontend shows frames in a window and reads buttons and hotkeys
+// from the keyboard and gamepads through the Bindings. GLFW has to be driven
+// from the main thread.
+type glfwFrontend struct {
+	window    *glfw.Window
+	bindings  *Bindings
+	input     inputState
+	tapped    map[glfw.Key]bool // Pressed since the last update
+	released  []glfw.Key        // Released before an update saw them pressed
+	active    [ACTION_COUNT]bool
+	buttons   gbemu.ButtonState
+	reported  gbemu.ButtonState
+	pacer     gbemu.FramePacer
+	slots     saveStateSlots
+	emulator  *gbemu.Emulator
+	rewinding bool
+}
+
+func CreateGLFWFrontend(pacer gbemu.FramePacer, slots saveStateSlots, bindings *Bindings) (*glfwFrontend, error) {
+	if err := glfw.Init(); err != nil {
+		return nil, fmt.Errorf("ERROR initializing GLFW: %s", err)
+	}
+
+	window, err := glfw.CreateWindow(gbemu.SCREEN_WIDTH, gbemu.SCREEN_HEIGHT, "GB Emulator", nil, nil)
+	if err != nil {
+		glfw.Terminate()
+		return nil, fmt.Errorf("ERROR creating window: %s", err)
+	}
+	window.MakeContextCurrent()
+	glfw.SwapInterval(0) // Pacing is done by the FramePacer, not vsync
+
+	if err := gl.Init(); err != nil {
+		glfw.Terminate()
+		return nil, fmt.Errorf("ERROR initializing OpenGL: %s", err)
+	}
+
+	gl.Viewport(0, 0, int32(gbemu.SCREEN_WIDTH), int32(gbemu.SCREEN_HEIGHT))
+	gl.MatrixMode(gl.PROJECTION)
+	gl.LoadIdentity()
+	gl.Ortho(0, float64(gbemu.SCREEN_WIDTH), float64(gbemu.SCREEN_HEIGHT), 0, -1, 1)
+	gl.ClearColor(0.255, 0.255, 0.255, 0)
+	gl.Clear(gl.COLOR_BUFFER_BIT)
+	gl.MatrixMode(gl.MODELVIEW)
+	gl.LoadIdentity()
+
+	f := &glfwFrontend{
+		window:   window,
+		bindings: bindings,
+		input:    inputState{keys: map[glfw.Key]bool{}},
+		tapped:   map[glfw.Key]bool{},
+		pacer:    pacer,
+		slots:    slots,
+	}
+	window.SetKeyCallback(f.onKey)
+	window.SetPos(0, 0)
+	return f, nil
+}
+
+// Keys are only tracked here and evaluated once per loop in update, so a key
+// tapped between two updates still counts as held for one of them
+func (f *glfwFrontend) onKey(_ *glfw.Window, key glfw.Key, scancode int, action glfw.Action, modifier glfw.ModifierKey) {
+	switch action {
+	case glfw.Press:
+		f.input.keys[key] = true
+		f.tapped[key] = true
+	case glfw.Release:
+		if f.tapped[key] {
+			f.released = append(f.released, key)
+		} else {
+			f.input.keys[key] = false
+		}
+	}
+}
+
+// update evaluates every binding, runs the hotkeys that changed and works
+// out which Game Boy buttons are held
+func (f *glfwFrontend) update() {
+	f.bindings.UpdateModifiers(&f.input)
+	f.input.gamepads = f.input.gamepads[:0]
+	for joystick := glfw.Joystick1; joystick <= glfw.JoystickLast; joystick++ {
+		if !joystick.IsGamepad() {
+			continue
+		}
+		if state := joystick.GetGamepadState(); state != nil {
+			f.input.gamepads = append(f.input.gamepads, state)
+		}
+	}
+
+	previous := f.active
+	for action := bindingAction(0); action < ACTION_COUNT; action++ {
+		f.active[action] = f.bindings.Active(action, &f.input)
+	}
+	for _, key := range f.released {
+		f.input.keys[key] = false
+	}
+	f.released = f.released[:0]
+	for key := range f.tapped {
+		delete(f.tapped, key)
+	}
+
+	f.buttons = 0
+	for button := gbemu.BUTTON_A; button <= gbemu.BUTTON_DOWN; button++ {
+		f.buttons = f.buttons.With(button, f.active[button])
+	}
+	for action := ACTION_FAST_FORWARD; action < ACTION_COUNT; action++ {
+		if f.active[action] != previous[action] {
+			f.handleHotkey(action, f.active[action])
+		}
+	}
+}
+
+func (f *glfwFrontend) handleHotkey(action bindingAction, pressed bool) {
+	switch {
+	case action == ACTION_FAST_FORWARD:
+		f.pacer.SetFastForward(pressed)
+	case action == ACTION_SLOW_MOTION:
+		f.pacer.SetSlowMotion(pressed)
+	case action == ACTION_PAUSE && pressed:
+		f.pacer.TogglePause()
+	case action == ACTION_FRAME_ADVANCE && pressed:
+		f.pacer.AdvanceFrame()
+	case action == ACTION_REWIND:
+		f.rewinding = pressed
+	case action >= ACTION_LOAD_STATE_1 && pressed:
+		f.slots.Load(f.emulator, int(action-ACTION_LOAD_STATE_1)+1)
+	case action >= ACTION_SAVE_STATE_1 && pressed:
+		f.slots.Save(f.emulator, int(action-ACTION_SAVE_STATE_1)+1)
+	}
+	f.updateTitle()
+}
+
+func (f *glfwFrontend) updateTitle() {
+	title := "GB Emulator"
+	if f.rewinding {
+		title += " [rewinding]"
+	} else if f.pacer.Paused() {
+		title += " [paused]"
+	} else if speed := f.pacer.Speed(); speed <= 0 {
+		title += " [uncapped]"
+	} else if speed != 1 {
+		title += fmt.Sprintf(" [%gx]", speed)
+	}
+	f.window.SetTitle(title)
+}
+
+func (f *glfwFrontend) PollInput() []gbemu.KeyPress {
+	keyPresses := []gbemu.KeyPress{}
+	for button := gbemu.BUTTON_A; button <= gbemu.BUTTON_DOWN; button++ {
+		if pressed := f.buttons.Pressed(button); pressed != f.reported.Pressed(button) {
+			keyPresses = append(keyPresses, gbemu.KeyPress{Button: button, Pressed: pressed})
+		}
+	}
+	f.reported = f.buttons
+	return keyPresses
+}
+
+func (f *glfwFrontend) PresentFrame(frame *gbemu.Framebuffer) {
+	gl.Clear(gl.COLOR_BUFFER_BIT)
+	gl.Disable(gl.DEPTH_TEST)
+	gl.PointSize(1.0)
+	gl.Begin(gl.POINTS)
+	for y := 0; y < gbemu.SCREEN_HEIGHT; y++ {
+		for x := 0; x < gbemu.SCREEN_WIDTH; x++ {
+			pixel := frame[y][x]
+			gl.Color3ub(pixel.Red, pixel.Green, pixel.Blue)
+			gl.Vertex2i(int32(x), int32(y))
+		}
+	}
+	gl.End()
+	f.window.SwapBuffers()
+}
+
+// Run drives the emulator until the window is closed or stop is closed
+func (f *glfwFrontend) Run(emulator *gbemu.Emulator, stop <-chan struct{}) {
+	defer glfw.Terminate()
+	f.emulator = emulator
+	emulator.SetInputSource(f)
+	emulator.AddFrameSink(f)
+	f.updateTitle()
+	for !f.window.ShouldClose() && !stopped(stop) {
+		glfw.PollEvents()
+		f.update()
+		if f.rewinding {
+			emulator.Rewind()
+		} else if f.pacer.ShouldRunFrame() {
+			emulator.RunFrame()
+			if err := emulator.Err(); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		f.pacer.Wait()
+	}
+}
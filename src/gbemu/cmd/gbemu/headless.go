@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"image/png"
+	"os"
+
+	"github.com/mpbart/gbemulator/src/gbemu"
+)
+
+// The headless frontend runs the core with no window for a fixed number of
+// frames, e.g. for CI or test ROMs, optionally saving the last frame as a PNG.
+type headlessFrontend struct {
+	frames     int
+	screenshot string
+	lastFrame  gbemu.Framebuffer
+}
+
+func CreateHeadlessFrontend(frames int, screenshot string) *headlessFrontend {
+	return &headlessFrontend{
+		frames:     frames,
+		screenshot: screenshot,
+	}
+}
+
+func (h *headlessFrontend) PresentFrame(frame *gbemu.Framebuffer) {
+	h.lastFrame = *frame
+}
+
+// Run runs the emulator for the number of frames or until stop is closed
+func (h *headlessFrontend) Run(emulator *gbemu.Emulator, stop <-chan struct{}) error {
+	emulator.AddFrameSink(h)
+	for i := 0; i < h.frames && !stopped(stop); i++ {
+		emulator.RunFrame()
+		if err := emulator.Err(); err != nil {
+			return err
+		}
+	}
+
+	if h.screenshot == "" {
+		return nil
+	}
+	return WriteScreenshot(h.screenshot, &h.lastFrame)
+}
+
+func WriteScreenshot(filename string, frame *gbemu.Framebuffer) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("ERROR creating screenshot: %s", err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, frame.Image()); err != nil {
+		return fmt.Errorf("ERROR writing screenshot: %s", err)
+	}
+	return nil
+}
+
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
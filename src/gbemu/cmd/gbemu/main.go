@@ -0,0 +1,254 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/mpbart/gbemulator/src/gbemu"
+)
+
+func initialize() {
+	runtime.LockOSThread()
+	//runtime.GOMAXPROCS(runtime.NumCPU() - 1)
+}
+
+func main() {
+	initialize()
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "tracediff":
+			os.Exit(gbemu.RunTraceDiff(os.Args[2:]))
+		case "disasm":
+			os.Exit(gbemu.RunDisassembler(os.Args[2:]))
+		}
+	}
+
+	romFile := flag.String("rom", "tetris.gb", "path to the ROM to run")
+	symFile := flag.String("sym", "", "path to an RGBDS/no$gmb symbol file (defaults to the ROM name with a .sym extension)")
+	traceFile := flag.String("trace", "", "write a Gameboy Doctor compatible trace of every executed instruction to this file")
+	traceStart := flag.String("trace-start", "0000", "first PC (hex) to include in the trace")
+	traceEnd := flag.String("trace-end", "FFFF", "last PC (hex) to include in the trace")
+	traceBank := flag.Int("trace-bank", -1, "only trace instructions in this ROM bank (-1 for all banks)")
+	traceRing := flag.Int("trace-ring", 0, "only keep the last N traced instructions and write them out on a crash")
+	traceLabels := flag.Bool("trace-labels", false, "annotate trace lines with label+offset (breaks Gameboy Doctor compatibility)")
+	profileFile := flag.String("profile", "", "profile executed cycles and write <file>.txt and <file>.pb.gz (pprof) on exit")
+	cdlFile := flag.String("cdl", "", "record how each ROM byte is used (code, data, DMA source, tile data) into this code/data log")
+	heatmapPrefix := flag.String("heatmap", "", "count memory reads/writes and export <prefix>_<frame>.png/.csv heatmaps")
+	heatmapFrames := flag.Int("heatmap-frames", 60, "number of frames covered by each exported heatmap")
+	headless := flag.Bool("headless", false, "run without a window")
+	frames := flag.Int("frames", 600, "number of frames to run for when headless (defaults to the movie length with -play-movie)")
+	screenshot := flag.String("screenshot", "", "write the last frame to this PNG when headless")
+	speed := flag.Float64("speed", 1, "emulation speed as a multiple of real hardware (0 for uncapped)")
+	fastForward := flag.Float64("fast-forward", 0, "speed while the fast-forward key is held (0 for uncapped)")
+	slowMotion := flag.Float64("slow-motion", 0.5, "speed while the slow motion key is held")
+	rewindMB := flag.Int("rewind-mb", 64, "memory in MiB used for rewind snapshots (0 disables rewinding)")
+	rewindInterval := flag.Int("rewind-interval", 2, "frames between rewind snapshots")
+	recordMovie := flag.String("record-movie", "", "record input into this movie file, written on exit")
+	playMovie := flag.String("play-movie", "", "play back the input from this movie file")
+	bindingsFile := flag.String("bindings", "", "read key, gamepad and hotkey bindings from this file (see bindings.go for the format)")
+	loadState := flag.Int("load-state", 0, "load the save state in this slot (1-9) on startup")
+	noAccessBlocking := flag.Bool("no-access-blocking", false, "let the CPU access VRAM/OAM while the PPU is using them, for games that break with the lockout")
+	flag.Parse()
+
+	rom, err := ioutil.ReadFile(*romFile)
+	if err != nil {
+		fmt.Printf("ERROR opening ROM: %s\n", err)
+		return
+	}
+
+	options := gbemu.Options{RewindInterval: *rewindInterval, NoAccessBlocking: *noAccessBlocking}
+	if !*headless {
+		options.RewindBudget = *rewindMB << 20
+	}
+	symbols, err := gbemu.InitializeSymbols(*romFile, *symFile)
+	if err != nil {
+		fmt.Println(err)
+	} else if symbols != nil {
+		options.Symbols = symbols
+	}
+
+	exitHooks := []func(){}
+	if *profileFile != "" {
+		if symbols == nil {
+			symbols = gbemu.CreateSymbolTable()
+		}
+		profiler := gbemu.CreateProfiler(symbols, filepath.Base(*romFile))
+		options.Profiler = profiler
+		exitHooks = append(exitHooks, func() {
+			if err := writeProfile(profiler, *profileFile); err != nil {
+				fmt.Println(err)
+			}
+		})
+	}
+	if *cdlFile != "" {
+		logger := gbemu.InitializeCodeDataLogger(*cdlFile, len(rom))
+		options.CodeDataLogger = logger
+		exitHooks = append(exitHooks, func() {
+			if err := logger.Write(*cdlFile); err != nil {
+				fmt.Println(err)
+			}
+		})
+	}
+	if *heatmapPrefix != "" {
+		options.Heatmap = gbemu.CreateHeatmap(*heatmapPrefix, *heatmapFrames)
+	}
+
+	emulator, err := gbemu.New(rom, options)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if *traceFile != "" {
+		traceOptions := gbemu.TraceOptions{Filename: *traceFile, Bank: *traceBank, RingSize: *traceRing}
+		if traceOptions.StartPC, err = parseHexAddress(*traceStart); err != nil {
+			fmt.Println(err)
+			return
+		}
+		if traceOptions.EndPC, err = parseHexAddress(*traceEnd); err != nil {
+			fmt.Println(err)
+			return
+		}
+		if *traceLabels && options.Symbols != nil {
+			traceOptions.Symbols = options.Symbols
+		}
+
+		tracer, err := gbemu.CreateTracer(emulator.MMU(), traceOptions)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		emulator.CPU().SetTracer(tracer)
+		defer dumpTraceOnPanic(tracer)
+		exitHooks = append(exitHooks, func() {
+			if err := tracer.Close(); err != nil {
+				fmt.Println(err)
+			}
+		})
+	}
+
+	slots := createSaveStateSlots(*romFile)
+	if *loadState != 0 {
+		slots.Load(emulator, *loadState)
+	}
+
+	if *playMovie != "" {
+		movie, err := gbemu.LoadMovieFile(*playMovie)
+		if err == nil {
+			err = emulator.PlayMovie(movie)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if !flagPassed("frames") {
+			*frames = len(movie.Frames)
+		}
+	}
+	if *recordMovie != "" {
+		if err := emulator.RecordMovie(); err != nil {
+			fmt.Println(err)
+			return
+		}
+		exitHooks = append(exitHooks, func() {
+			if err := emulator.StopRecording().WriteFile(*recordMovie); err != nil {
+				fmt.Println(err)
+			}
+		})
+	}
+	stop := stopOnInterrupt()
+
+	if *headless {
+		if err := CreateHeadlessFrontend(*frames, *screenshot).Run(emulator, stop); err != nil {
+			fmt.Println(err)
+		}
+	} else {
+		bindings := DefaultBindings()
+		if *bindingsFile != "" {
+			if loaded, err := LoadBindings(*bindingsFile); err != nil {
+				fmt.Println(err)
+				fmt.Println("Using the default bindings")
+			} else {
+				bindings = loaded
+			}
+		}
+		frontend, err := CreateGLFWFrontend(gbemu.CreateFramePacer(*speed, *fastForward, *slowMotion), slots, bindings)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		frontend.Run(emulator, stop)
+	}
+
+	for _, hook := range exitHooks {
+		hook()
+	}
+}
+
+func flagPassed(name string) bool {
+	passed := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
+}
+
+func parseHexAddress(value string) (uint16, error) {
+	addr, err := strconv.ParseUint(strings.TrimPrefix(value, "0x"), 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("ERROR parsing address %q: %s", value, err)
+	}
+	return uint16(addr), nil
+}
+
+func dumpTraceOnPanic(tracer gbemu.Tracer) {
+	if r := recover(); r != nil {
+		tracer.Dump()
+		panic(r)
+	}
+}
+
+// Ctrl-C closes the stop channel so the frontend returns and traces, profiles
+// etc. are written out by the main goroutine once the emulator has stopped.
+// A second Ctrl-C kills the emulator straight away.
+func stopOnInterrupt() <-chan struct{} {
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		close(stop)
+	}()
+	return stop
+}
+
+func writeProfile(profiler gbemu.Profiler, filename string) error {
+	report, err := os.Create(filename + ".txt")
+	if err != nil {
+		return fmt.Errorf("ERROR creating profile report: %s", err)
+	}
+	defer report.Close()
+	profiler.WriteReport(report)
+
+	profile, err := os.Create(filename + ".pb.gz")
+	if err != nil {
+		return fmt.Errorf("ERROR creating pprof profile: %s", err)
+	}
+	defer profile.Close()
+	if err := profiler.WriteProfile(profile); err != nil {
+		return fmt.Errorf("ERROR writing pprof profile: %s", err)
+	}
+	fmt.Printf("Wrote profile to %s.txt and %s.pb.gz\n", filename, filename)
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/mpbart/gbemulator/src/gbemu"
+)
+
+// Save state slots are stored next to the ROM as <rom name>.ss<slot>
+type saveStateSlots struct {
+	prefix string
+}
+
+func createSaveStateSlots(romFile string) saveStateSlots {
+	return saveStateSlots{prefix: strings.TrimSuffix(romFile, filepath.Ext(romFile))}
+}
+
+func (s saveStateSlots) Path(slot int) string {
+	return fmt.Sprintf("%s.ss%d", s.prefix, slot)
+}
+
+func (s saveStateSlots) Save(emulator *gbemu.Emulator, slot int) {
+	if err := emulator.SaveStateFile(s.Path(slot)); err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("Saved state to slot %d\n", slot)
+}
+
+func (s saveStateSlots) Load(emulator *gbemu.Emulator, slot int) {
+	if err := emulator.LoadStateFile(s.Path(slot)); err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("Loaded state from slot %d\n", slot)
+}
@@ -1,4 +1,4 @@
-package main
+package gbemu
 
 import (
 	"bufio"
@@ -18,6 +18,13 @@ type CPU interface {
 	Reset()
 	Tick()
 	SetInterruptMasterEnable(bool)
+	SetSymbols(SymbolTable)
+	SetTracer(Tracer)
+	SetProfiler(Profiler)
+	Registers() Registers
+	InstructionsExecuted() uint64
+	Err() error
+	Snapshotter
 }
 
 type cpu struct {
@@ -25,8 +32,11 @@ type cpu struct {
 	registers             Registers
 	instructions          map[byte]Instruction
 	stopped               bool
+	halted                bool   // Set by HALT, no instructions run until IE & IF is non-zero
+	haltPC                uint16 // Where the CPU halted and how long for, for the profiler
+	haltCycles            int
 	InstructionTicks      int
-	exitChannel           chan bool
+	err                   error // Set when the CPU hits an unknown opcode, it won't run again until reset
 	currentInstruction    Instruction
 	currentOpcode         byte
 	currentParamBytes     int
@@ -35,9 +45,14 @@ type cpu struct {
 	interruptMasterEnable bool
 	ticks                 int
 	breakAddresses        []uint16
+	symbols               SymbolTable
+	tracer                Tracer
+	callStack             CallStack
+	profiler              Profiler
+	instructionsExecuted  uint64
 }
 
-func CreateCPU(exitChannel chan bool, mmu MMU) CPU {
+func CreateCPU(mmu MMU) CPU {
 	registers := CreateRegisters(mmu)
 
 	cpu := &cpu{
@@ -46,15 +61,16 @@ func CreateCPU(exitChannel chan bool, mmu MMU) CPU {
 		instructions:          nil,
 		stopped:               false,
 		InstructionTicks:      4, // Current assumption is that the first instruction is always 4 cycles. May need to refactor and hold instructions as state to fix this
-		exitChannel:           exitChannel,
 		currentInstruction:    nil,
 		currentOpcode:         0,
 		currentParamBytes:     0,
 		currentParams:         Parameters{},
 		getInput:              false,
 		interruptMasterEnable: false,
-		ticks:          0,
-		breakAddresses: []uint16{0x60},
+		ticks:                 0,
+		breakAddresses:        []uint16{},
+		symbols:               CreateSymbolTable(),
+		callStack:             CreateCallStack(),
 	}
 
 	cpu.instructions = CreateInstructions(registers, mmu, cpu)
@@ -63,47 +79,50 @@ func CreateCPU(exitChannel chan bool, mmu MMU) CPU {
 
 func (cpu *cpu) Reset() {
 	cpu.registers.WritePC(0x100)
-	cpu.registers.PushSP(0xFFFE)
+	cpu.registers.WriteSP(0xFFFE)
 	cpu.registers.WriteRegisterPair(a, f, 0x01B0)
 	cpu.registers.WriteRegisterPair(b, c, 0x0013)
 	cpu.registers.WriteRegisterPair(d, e, 0x00D8)
 	cpu.registers.WriteRegisterPair(h, l, 0x014D)
 
-	cpu.mmu.WriteByte(0xFF05, 0x00)
-	cpu.mmu.WriteByte(0xFF06, 0x00)
-	cpu.mmu.WriteByte(0xFF07, 0x00)
-	cpu.mmu.WriteByte(0xFF10, 0x80)
-	cpu.mmu.WriteByte(0xFF11, 0xBF)
-	cpu.mmu.WriteByte(0xFF12, 0xF3)
-	cpu.mmu.WriteByte(0xFF14, 0xBF)
-	cpu.mmu.WriteByte(0xFF16, 0x3F)
-	cpu.mmu.WriteByte(0xFF17, 0x00)
-	cpu.mmu.WriteByte(0xFF19, 0xBF)
-	cpu.mmu.WriteByte(0xFF1A, 0x7F)
-	cpu.mmu.WriteByte(0xFF1B, 0xFF)
-	cpu.mmu.WriteByte(0xFF1C, 0x9F)
-	cpu.mmu.WriteByte(0xFF1E, 0xBF)
-	cpu.mmu.WriteByte(0xFF20, 0xFF)
-	cpu.mmu.WriteByte(0xFF21, 0x00)
-	cpu.mmu.WriteByte(0xFF22, 0x00)
-	cpu.mmu.WriteByte(0xFF23, 0xBF)
-	cpu.mmu.WriteByte(0xFF24, 0x77)
-	cpu.mmu.WriteByte(0xFF25, 0xF3)
-	cpu.mmu.WriteByte(0xFF26, 0xF1)
-	cpu.mmu.WriteByte(0xFF40, 0x91)
+	cpu.mmu.PokeAt(0xFF05, 0x00)
+	cpu.mmu.PokeAt(0xFF06, 0x00)
+	cpu.mmu.PokeAt(0xFF07, 0x00)
+	cpu.mmu.PokeAt(0xFF10, 0x80)
+	cpu.mmu.PokeAt(0xFF11, 0xBF)
+	cpu.mmu.PokeAt(0xFF12, 0xF3)
+	cpu.mmu.PokeAt(0xFF14, 0xBF)
+	cpu.mmu.PokeAt(0xFF16, 0x3F)
+	cpu.mmu.PokeAt(0xFF17, 0x00)
+	cpu.mmu.PokeAt(0xFF19, 0xBF)
+	cpu.mmu.PokeAt(0xFF1A, 0x7F)
+	cpu.mmu.PokeAt(0xFF1B, 0xFF)
+	cpu.mmu.PokeAt(0xFF1C, 0x9F)
+	cpu.mmu.PokeAt(0xFF1E, 0xBF)
+	cpu.mmu.PokeAt(0xFF20, 0xFF)
+	cpu.mmu.PokeAt(0xFF21, 0x00)
+	cpu.mmu.PokeAt(0xFF22, 0x00)
+	cpu.mmu.PokeAt(0xFF23, 0xBF)
+	cpu.mmu.PokeAt(0xFF24, 0x77)
+	cpu.mmu.PokeAt(0xFF25, 0xF3)
+	cpu.mmu.PokeAt(0xFF26, 0xF1)
+	cpu.mmu.PokeAt(0xFF40, 0x91)
 	cpu.mmu.SetLCDStatusMode(0x02) // Set status to OAM
-	cpu.mmu.WriteByte(0xFF42, 0x00)
-	cpu.mmu.WriteByte(0xFF43, 0x00)
-	cpu.mmu.WriteByte(0xFF45, 0x00)
-	cpu.mmu.WriteByte(0xFF47, 0xFC)
-	cpu.mmu.WriteByte(0xFF48, 0xFF)
-	cpu.mmu.WriteByte(0xFF49, 0xFF)
-	cpu.mmu.WriteByte(0xFF4A, 0x00)
-	cpu.mmu.WriteByte(0xFF4B, 0x00)
-	cpu.mmu.WriteByte(0xFF50, 0x00)
-	cpu.mmu.WriteByte(0xFFFF, 0x00)
+	cpu.mmu.PokeAt(0xFF42, 0x00)
+	cpu.mmu.PokeAt(0xFF43, 0x00)
+	cpu.mmu.PokeAt(0xFF45, 0x00)
+	cpu.mmu.PokeAt(0xFF47, 0xFC)
+	cpu.mmu.PokeAt(0xFF48, 0xFF)
+	cpu.mmu.PokeAt(0xFF49, 0xFF)
+	cpu.mmu.PokeAt(0xFF4A, 0x00)
+	cpu.mmu.PokeAt(0xFF4B, 0x00)
+	cpu.mmu.PokeAt(0xFF50, 0x00)
+	cpu.mmu.PokeAt(0xFFFF, 0x00)
 
 	cpu.stopped = false
+	cpu.halted = false
+	cpu.err = nil
+	cpu.callStack.Reset()
 	cpu.decodeNextInstruction()
 }
 
@@ -112,20 +131,43 @@ func (c *cpu) IncrementPC(offset int) {
 }
 
 func (c *cpu) Tick() {
+	if c.err != nil {
+		return
+	}
 	if c.mmu.HasPendingInterrupt() && c.interruptMasterEnable {
+		c.wake()
 		c.executeInstruction() // Always execute the pending instruction before running interrupt routine
+		c.wake()               // A HALT with an interrupt already pending doesn't halt
 
 		interruptVector := c.mmu.GetNextPendingInterrupt()
 		c.mmu.ClearHighestInterrupt()
-		c.registers.PushSP(c.registers.ReadPC() + uint16(c.currentInstruction.GetNumParameterBytes()))
+		interruptedPC := c.registers.ReadPC()
+		returnAddress := interruptedPC + uint16(c.currentInstruction.GetNumParameterBytes())
+		c.registers.PushSP(returnAddress)
 		//fmt.Printf("Pushing PC: %x\n", c.registers.ReadPC())
 		c.registers.WritePC(interruptVector)
+		c.callStack.Push(StackFrame{
+			CallSite:      interruptedPC,
+			Target:        interruptVector,
+			ReturnAddress: returnAddress,
+			SP:            c.registers.ReadSP(),
+			Bank:          0,
+			Interrupt:     true,
+		})
 		c.InstructionTicks = 12
 		c.interruptMasterEnable = false
 
 		c.decodeNextInstruction() // Get and decode instruction at the interrupt
 	}
 
+	if c.halted {
+		if !c.mmu.HasPendingInterrupt() {
+			c.haltCycles += 1
+			return
+		}
+		c.wake()
+	}
+
 	if c.InstructionTicks != 0 {
 		c.InstructionTicks -= 1
 		return
@@ -140,7 +182,7 @@ func (c *cpu) Tick() {
 }
 
 func (c *cpu) getNextInstruction() uint8 {
-	return c.mmu.ReadAt(c.registers.ReadPC())
+	return c.mmu.FetchInstructionByte(c.registers.ReadPC(), false)
 }
 
 func (c *cpu) decodeNextInstruction() {
@@ -148,8 +190,10 @@ func (c *cpu) decodeNextInstruction() {
 	instruction, found := c.instructions[c.currentOpcode]
 
 	if !found {
-		fmt.Printf("ERROR: Opcode %x not found\n", c.currentOpcode)
-		c.exitChannel <- true
+		c.err = fmt.Errorf("ERROR opcode %02X not found at %04X", c.currentOpcode, c.registers.ReadPC())
+		if c.tracer != nil {
+			c.tracer.Dump()
+		}
 		return
 	}
 
@@ -158,7 +202,7 @@ func (c *cpu) decodeNextInstruction() {
 	c.currentParams = make(Parameters, c.currentParamBytes)
 	if c.currentParamBytes > 0 {
 		for i := 0; i < c.currentParamBytes; i++ {
-			c.currentParams[i] = c.mmu.ReadAt(c.registers.ReadPC() + uint16(i+1))
+			c.currentParams[i] = c.mmu.FetchInstructionByte(c.registers.ReadPC()+uint16(i+1), true)
 		}
 	}
 
@@ -166,11 +210,23 @@ func (c *cpu) decodeNextInstruction() {
 }
 
 func (c *cpu) executeInstruction() {
+	c.instructionsExecuted += 1
+	pc := c.registers.ReadPC()
+	if c.tracer != nil {
+		c.tracer.Trace(c.registers, c.currentBank())
+	}
+	if c.profiler != nil && c.currentOpcode != 0x76 { // HALT is recorded when the CPU wakes up
+		cycles := c.currentInstruction.GetCycles(c.currentParams)
+		c.profiler.Record(pc, c.currentBank(), cycles, false, c.callStack.Frames(c.registers.ReadSP()))
+	}
 	result := c.currentInstruction.Execute(c.currentParams)
 
 	//fmt.Printf("executed %x at %x\n", c.currentOpcode, c.registers.ReadPC())
 	if c.atBreakpoint() || c.getInput {
 		c.registers.DumpContents(c.ticks)
+		if label := c.symbols.Symbolize(c.currentBank(), c.registers.ReadPC()); label != "" {
+			fmt.Printf("At %s\n", label)
+		}
 	debug:
 		for {
 			fmt.Print("<Enter Debug Command> ")
@@ -179,15 +235,25 @@ func (c *cpu) executeInstruction() {
 			command := strings.Trim(str, "\n")
 			switch command {
 			case "M", "m": //Check memory location
-				fmt.Print("Enter memory location to print:")
+				fmt.Print("Enter memory location or label to print:")
 				rawAddress, _ := reader.ReadString('\n')
 				address := strings.Trim(rawAddress, "\n")
-				addr, err := strconv.ParseUint(address, 16, 16)
+				addr, err := c.parseAddress(address)
 				if err != nil {
 					fmt.Println(err)
 					continue
 				}
-				fmt.Printf("%x\n", c.mmu.ReadAt(uint16(addr)))
+				fmt.Printf("%x\n", c.mmu.PeekAt(addr))
+			case "D", "d": // Disassemble from the current PC
+				addr := c.registers.ReadPC()
+				for i := 0; i < 10; i++ {
+					instruction := Disassemble(c.mmu.PeekAt, addr, c.bankAt(addr), c.symbols)
+					if label, found := c.symbols.Lookup(c.bankAt(addr), addr); found {
+						fmt.Printf("%s:\n", label)
+					}
+					fmt.Println(instruction)
+					addr += uint16(len(instruction.Bytes))
+				}
 			case "C", "c": // continue
 				c.getInput = true
 				break debug
@@ -208,20 +274,24 @@ func (c *cpu) executeInstruction() {
 			*/
 			case "B", "b": // Add breakpoint
 				c.getInput = false
-				fmt.Print("Enter PC to break at:")
+				fmt.Print("Enter PC or label to break at:")
 				rawPC, _ := reader.ReadString('\n')
 				strippedPC := strings.Trim(rawPC, "\n")
-				pc, err := strconv.ParseUint(strippedPC, 16, 16)
+				bp, err := c.parseAddress(strippedPC)
 				if err != nil {
 					fmt.Println(err)
 					continue
 				}
-				c.breakAddresses = append(c.breakAddresses, uint16(pc))
+				c.breakAddresses = append(c.breakAddresses, bp)
+			case "BT", "bt": // Print the call stack
+				c.printBacktrace()
 			case "H", "h": // print help
 				fmt.Println("M,m - view value at memory location 0x<input>")
 				fmt.Println("C,c - continue and break after next cpu cycle")
 				fmt.Println("E,e - exit debugger and continue running")
 				fmt.Println("B,b - add new breakpoint")
+				fmt.Println("D,d - disassemble instructions at the current PC")
+				fmt.Println("BT,bt - print a backtrace of the current call stack")
 			default:
 				continue
 			}
@@ -234,16 +304,119 @@ func (c *cpu) executeInstruction() {
 		c.IncrementPC(c.currentParamBytes + 1)
 	}
 
+	c.trackCalls(pc, result)
+
 	if result.IsStopped() {
 		c.stopped = true
 	}
+	if c.currentOpcode == 0x76 {
+		c.halted = true
+		c.haltPC = pc
+		c.haltCycles = c.currentInstruction.GetCycles(c.currentParams)
+	}
 	c.ticks += 1
 }
 
+// wake leaves HALT and records the whole time spent halted as a single HALT
+func (c *cpu) wake() {
+	if !c.halted {
+		return
+	}
+	c.halted = false
+	if c.profiler != nil {
+		c.profiler.Record(c.haltPC, c.bankAt(c.haltPC), c.haltCycles, true, c.callStack.Frames(c.registers.ReadSP()))
+	}
+}
+
+// Keeps the shadow call stack up to date. Conditional calls and returns only
+// count when they were taken.
+func (c *cpu) trackCalls(pc uint16, result Addresser) {
+	if !result.ShouldJump() {
+		return
+	}
+
+	switch c.currentOpcode {
+	case 0xCD, 0xC4, 0xCC, 0xD4, 0xDC, 0xC7, 0xCF, 0xD7, 0xDF, 0xE7, 0xEF, 0xF7, 0xFF: // CALL, RST
+		c.callStack.Push(StackFrame{
+			CallSite:      pc,
+			Target:        result.NewAddress(),
+			ReturnAddress: pc + uint16(c.currentParamBytes+1),
+			SP:            c.registers.ReadSP(),
+			Bank:          c.currentBank(),
+		})
+	case 0xC9, 0xC0, 0xC8, 0xD0, 0xD8, 0xD9: // RET, RETI
+		c.callStack.Return(c.registers.ReadSP())
+	}
+}
+
+func (c *cpu) printBacktrace() {
+	pc := c.registers.ReadPC()
+	location := fmt.Sprintf("%04X", pc)
+	if label := c.symbols.Symbolize(c.currentBank(), pc); label != "" {
+		location = fmt.Sprintf("%04X %s", pc, label)
+	}
+	fmt.Printf("#0  %s\n", location)
+	frames := c.callStack.Frames(c.registers.ReadSP())
+	for i := len(frames) - 1; i >= 0; i-- {
+		fmt.Printf("#%-2d %s\n", len(frames)-i, frames[i].Describe(c.symbols))
+	}
+}
+
 func (c *cpu) SetInterruptMasterEnable(value bool) {
 	c.interruptMasterEnable = value
 }
 
+func (c *cpu) SetSymbols(symbols SymbolTable) {
+	c.symbols = symbols
+}
+
+func (c *cpu) SetTracer(tracer Tracer) {
+	c.tracer = tracer
+}
+
+func (c *cpu) SetProfiler(profiler Profiler) {
+	c.profiler = profiler
+}
+
+func (c *cpu) Registers() Registers {
+	return c.registers
+}
+
+func (c *cpu) InstructionsExecuted() uint64 {
+	return c.instructionsExecuted
+}
+
+// Err returns why the CPU stopped running, or nil while it runs
+func (c *cpu) Err() error {
+	return c.err
+}
+
+func (c *cpu) currentBank() int {
+	return c.bankAt(c.registers.ReadPC())
+}
+
+// Only 0x4000 - 0x7FFF is banked, everything else is reported as bank 0 like
+// RGBDS does in symbol files
+func (c *cpu) bankAt(address uint16) int {
+	if address < 0x4000 || address > 0x7FFF {
+		return 0
+	}
+	return c.mmu.ROMBank()
+}
+
+// Debugger addresses can be given as hex values or as labels from the loaded
+// symbol file, optionally followed by a hex offset (e.g. Main+1a)
+func (c *cpu) parseAddress(input string) (uint16, error) {
+	if addr, found := c.symbols.Resolve(input); found {
+		return addr, nil
+	}
+	addr, err := strconv.ParseUint(strings.TrimPrefix(input, "0x"), 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a known label or hex address", input)
+	}
+	return uint16(addr), nil
+}
+
 func (c *cpu) atBreakpoint() bool {
 	currentPc := c.registers.ReadPC()
 	for _, addr := range c.breakAddresses {
@@ -253,3 +426,60 @@ func (c *cpu) atBreakpoint() bool {
 	}
 	return false
 }
+
+func (cpu *cpu) SaveState(w *StateWriter) {
+	for _, reg := range []Register{a, b, c, d, e, f, h, l} {
+		w.WriteUint8(cpu.registers.ReadRegister(reg))
+	}
+	w.WriteUint16(cpu.registers.ReadPC())
+	w.WriteUint16(cpu.registers.ReadSP())
+	w.WriteBool(cpu.interruptMasterEnable)
+	w.WriteBool(cpu.stopped)
+	w.WriteBool(cpu.halted)
+	w.WriteUint16(cpu.haltPC)
+
+	// The instruction that has been decoded but not executed yet
+	w.WriteUint8(cpu.currentOpcode)
+	w.WriteInt(len(cpu.currentParams))
+	w.WriteBytes(cpu.currentParams)
+	w.WriteInt(cpu.InstructionTicks)
+	w.WriteInt(cpu.ticks)
+	w.WriteUint64(cpu.instructionsExecuted)
+}
+
+func (cpu *cpu) LoadState(r *StateReader) {
+	for _, reg := range []Register{a, b, c, d, e, f, h, l} {
+		cpu.registers.WriteRegister(reg, r.ReadUint8())
+	}
+	cpu.registers.WritePC(r.ReadUint16())
+	cpu.registers.WriteSP(r.ReadUint16())
+	cpu.interruptMasterEnable = r.ReadBool()
+	cpu.stopped = r.ReadBool()
+	cpu.halted = r.ReadBool()
+	cpu.haltPC = r.ReadUint16()
+	cpu.haltCycles = 0
+
+	opcode := r.ReadUint8()
+	params := make(Parameters, r.ReadCount(2))
+	r.ReadBytes(params)
+	instruction, found := cpu.instructions[opcode]
+	if !found {
+		r.Fail(fmt.Errorf("ERROR unknown opcode %02X in save state", opcode))
+		return
+	}
+	if len(params) != instruction.GetNumParameterBytes() {
+		r.Fail(fmt.Errorf("ERROR opcode %02X in save state has %d parameter bytes", opcode, len(params)))
+		return
+	}
+	cpu.err = nil
+	cpu.currentOpcode = opcode
+	cpu.currentInstruction = instruction
+	cpu.currentParamBytes = len(params)
+	cpu.currentParams = params
+	cpu.InstructionTicks = r.ReadInt()
+	cpu.ticks = r.ReadInt()
+	cpu.instructionsExecuted = r.ReadUint64()
+
+	// The shadow call stack can't be reconstructed, it starts over from here
+	cpu.callStack.Reset()
+}
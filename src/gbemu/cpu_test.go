@@ -0,0 +1,91 @@
+package gbemu
+
+import (
+	"io"
+	"testing"
+)
+
+func TestBankAt(t *testing.T) {
+	c := CreateCPU(CreateMMU()).(*cpu)
+	tests := []struct {
+		address uint16
+		bank    int
+	}{
+		{0x0150, 0},
+		{0x3FFF, 0},
+		{0x4000, 1},
+		{0x7FFF, 1},
+		{0x8000, 0},
+		{0xC000, 0},
+		{0xFF80, 0},
+	}
+	for _, test := range tests {
+		if got := c.bankAt(test.address); got != test.bank {
+			t.Errorf("bankAt(%04X) = %d, want %d", test.address, got, test.bank)
+		}
+	}
+}
+
+type haltRecorder struct {
+	haltCycles int
+	halts      int
+}
+
+func (p *haltRecorder) Record(pc uint16, bank int, cycles int, halted bool, frames []StackFrame) {
+	if halted {
+		p.halts += 1
+		p.haltCycles += cycles
+	}
+}
+
+func (p *haltRecorder) WriteReport(w io.Writer)        {}
+func (p *haltRecorder) WriteProfile(w io.Writer) error { return nil }
+
+func TestHalt(t *testing.T) {
+	tests := []struct {
+		name string
+		ime  bool
+		pc   uint16 // Where the CPU ends up after waking
+	}{
+		{"woken without IME", false, 0x0102},
+		{"woken by an interrupt", true, 0x0050},
+	}
+
+	for _, test := range tests {
+		rom := make([]byte, 0x8000)
+		copy(rom[0x100:], []byte{0x76, 0x3C, 0x18, 0xFE}) // HALT; INC A; JR -2
+		copy(rom[0x50:], []byte{0x18, 0xFE})              // Timer interrupt: JR -2
+		m := CreateMMU()
+		m.InitRom(rom)
+		c := CreateCPU(m)
+		c.Reset()
+		profiler := &haltRecorder{}
+		c.SetProfiler(profiler)
+		c.Registers().WriteRegister(a, 0)
+		c.SetInterruptMasterEnable(test.ime)
+		m.WriteByte(INTERRUPT_ENABLE, 0x04)
+		m.WriteByte(INTERRUPT_FLAGS, 0x00)
+
+		for i := 0; i < 1000; i++ {
+			c.Tick()
+		}
+		if pc := c.Registers().ReadPC(); pc != 0x0101 {
+			t.Errorf("%s: PC while halted = %04X, want 0101", test.name, pc)
+		}
+		executed := c.InstructionsExecuted()
+
+		m.WriteByte(INTERRUPT_FLAGS, 0x04)
+		for i := 0; i < 100; i++ {
+			c.Tick()
+		}
+		if c.InstructionsExecuted() == executed {
+			t.Errorf("%s: CPU didn't wake up", test.name)
+		}
+		if pc := c.Registers().ReadPC(); pc != test.pc {
+			t.Errorf("%s: PC after waking = %04X, want %04X", test.name, pc, test.pc)
+		}
+		if profiler.halts != 1 || profiler.haltCycles < 900 {
+			t.Errorf("%s: profiled %d halts taking %d cycles, want 1 taking at least 900", test.name, profiler.halts, profiler.haltCycles)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package gbemu
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Operand placeholders used in the mnemonic tables:
+//
+//	d8  - immediate byte
+//	d16 - immediate word
+//	a8  - offset from 0xFF00
+//	a16 - absolute address
+//	r8  - signed relative offset from the next instruction
+var opcodeMnemonics = [256]string{
+	"NOP", "LD BC,d16", "LD (BC),A", "INC BC", "INC B", "DEC B", "LD B,d8", "RLCA",
+	"LD (a16),SP", "ADD HL,BC", "LD A,(BC)", "DEC BC", "INC C", "DEC C", "LD C,d8", "RRCA",
+	"STOP d8", "LD DE,d16", "LD (DE),A", "INC DE", "INC D", "DEC D", "LD D,d8", "RLA",
+	"JR r8", "ADD HL,DE", "LD A,(DE)", "DEC DE", "INC E", "DEC E", "LD E,d8", "RRA",
+	"JR NZ,r8", "LD HL,d16", "LD (HL+),A", "INC HL", "INC H", "DEC H", "LD H,d8", "DAA",
+	"JR Z,r8", "ADD HL,HL", "LD A,(HL+)", "DEC HL", "INC L", "DEC L", "LD L,d8", "CPL",
+	"JR NC,r8", "LD SP,d16", "LD (HL-),A", "INC SP", "INC (HL)", "DEC (HL)", "LD (HL),d8", "SCF",
+	"JR C,r8", "ADD HL,SP", "LD A,(HL-)", "DEC SP", "INC A", "DEC A", "LD A,d8", "CCF",
+	// 0x40 - 0xBF are filled in by init()
+	0xC0: "RET NZ", "POP BC", "JP NZ,a16", "JP a16", "CALL NZ,a16", "PUSH BC", "ADD A,d8", "RST 00H",
+	"RET Z", "RET", "JP Z,a16", "PREFIX CB", "CALL Z,a16", "CALL a16", "ADC A,d8", "RST 08H",
+	"RET NC", "POP DE", "JP NC,a16", "", "CALL NC,a16", "PUSH DE", "SUB d8", "RST 10H",
+	"RET C", "RETI", "JP C,a16", "", "CALL C,a16", "", "SBC A,d8", "RST 18H",
+	"LDH (a8),A", "POP HL", "LD (C),A", "", "", "PUSH HL", "AND d8", "RST 20H",
+	"ADD SP,r8", "JP (HL)", "LD (a16),A", "", "", "", "XOR d8", "RST 28H",
+	"LDH A,(a8)", "POP AF", "LD A,(C)", "DI", "", "PUSH AF", "OR d8", "RST 30H",
+	"LD HL,SP+r8", "LD SP,HL", "LD A,(a16)", "EI", "", "", "CP d8", "RST 38H",
+}
+
+var extendedOpcodeMnemonics [256]string
+
+var mnemonicRegisters = []string{"B", "C", "D", "E", "H", "L", "(HL)", "A"}
+
+func init() {
+	aluOperations := []string{"ADD A,", "ADC A,", "SUB ", "SBC A,", "AND ", "XOR ", "OR ", "CP "}
+	for i := 0x40; i < 0xC0; i++ {
+		source := mnemonicRegisters[i&0x07]
+		if i < 0x80 {
+			opcodeMnemonics[i] = "LD " + mnemonicRegisters[(i>>3)&0x07] + "," + source
+		} else {
+			opcodeMnemonics[i] = aluOperations[(i>>3)&0x07] + source
+		}
+	}
+	opcodeMnemonics[0x76] = "HALT"
+
+	rotations := []string{"RLC", "RRC", "RL", "RR", "SLA", "SRA", "SWAP", "SRL"}
+	bitOperations := []string{"", "BIT", "RES", "SET"}
+	for i := 0; i < 256; i++ {
+		register := mnemonicRegisters[i&0x07]
+		if i < 0x40 {
+			extendedOpcodeMnemonics[i] = rotations[i>>3] + " " + register
+		} else {
+			extendedOpcodeMnemonics[i] = fmt.Sprintf("%s %d,%s", bitOperations[i>>6], (i>>3)&0x07, register)
+		}
+	}
+}
+
+type DisassembledInstruction struct {
+	Address  uint16
+	Bytes    []uint8
+	Mnemonic string
+}
+
+// InstructionLength returns the total size in bytes (opcode included) of the
+// instruction starting with the given opcode
+func InstructionLength(opcode uint8) int {
+	if opcode == 0xCB {
+		return 2
+	}
+	mnemonic := opcodeMnemonics[opcode]
+	switch {
+	case strings.Contains(mnemonic, "d16") || strings.Contains(mnemonic, "a16"):
+		return 3
+	case strings.Contains(mnemonic, "d8") || strings.Contains(mnemonic, "a8") || strings.Contains(mnemonic, "r8"):
+		return 2
+	default:
+		return 1
+	}
+}
+
+// Disassemble decodes the instruction at address using read to fetch bytes.
+// Jump and call targets are replaced with labels when symbols are available.
+func Disassemble(read func(uint16) uint8, address uint16, bank int, symbols SymbolTable) DisassembledInstruction {
+	opcode := read(address)
+	length := InstructionLength(opcode)
+	bytes := make([]uint8, length)
+	for i := range bytes {
+		bytes[i] = read(address + uint16(i))
+	}
+
+	return DisassembledInstruction{
+		Address:  address,
+		Bytes:    bytes,
+		Mnemonic: formatMnemonic(bytes, address, bank, symbols),
+	}
+}
+
+func formatMnemonic(bytes []uint8, address uint16, bank int, symbols SymbolTable) string {
+	opcode := bytes[0]
+	if opcode == 0xCB {
+		if len(bytes) < 2 {
+			return "PREFIX CB"
+		}
+		return extendedOpcodeMnemonics[bytes[1]]
+	}
+
+	mnemonic := opcodeMnemonics[opcode]
+	if mnemonic == "" {
+		return fmt.Sprintf("DB $%02X", opcode)
+	}
+	if len(bytes) < InstructionLength(opcode) {
+		return mnemonic
+	}
+
+	switch {
+	case strings.Contains(mnemonic, "d16"):
+		return strings.Replace(mnemonic, "d16", fmt.Sprintf("$%04X", readWord(bytes)), 1)
+	case strings.Contains(mnemonic, "a16"):
+		return strings.Replace(mnemonic, "a16", labelOrHex(readWord(bytes), bank, symbols), 1)
+	case strings.Contains(mnemonic, "d8"):
+		return strings.Replace(mnemonic, "d8", fmt.Sprintf("$%02X", bytes[1]), 1)
+	case strings.Contains(mnemonic, "a8"):
+		return strings.Replace(mnemonic, "a8", labelOrHex(0xFF00+uint16(bytes[1]), bank, symbols), 1)
+	case strings.HasPrefix(mnemonic, "JR"):
+		target := uint16(int(address) + 2 + int(int8(bytes[1])))
+		return strings.Replace(mnemonic, "r8", labelOrHex(target, bank, symbols), 1)
+	case strings.Contains(mnemonic, "r8"):
+		return strings.Replace(mnemonic, "r8", fmt.Sprintf("%d", int8(bytes[1])), 1)
+	}
+	return mnemonic
+}
+
+func (i DisassembledInstruction) String() string {
+	return fmt.Sprintf("%04X: %-9s %s", i.Address, hexString(i.Bytes), i.Mnemonic)
+}
+
+func readWord(bytes []uint8) uint16 {
+	return uint16(bytes[1]) + uint16(bytes[2])<<8
+}
+
+func labelOrHex(address uint16, bank int, symbols SymbolTable) string {
+	if symbols != nil {
+		if label, found := symbols.Lookup(bank, address); found {
+			return label
+		}
+	}
+	return fmt.Sprintf("$%04X", address)
+}
+
+// DisassembleROM writes a listing of the whole ROM. When a code/data log is
+// given only bytes that were executed are decoded as instructions, everything
+// else is emitted as data. Without one every byte is assumed to be code.
+func DisassembleROM(w io.Writer, rom []uint8, cdl []uint8, symbols SymbolTable) {
+	for offset := 0; offset < len(rom); {
+		bank, address := ROMAddress(offset)
+		if offset%0x4000 == 0 {
+			fmt.Fprintf(w, "\n; ROM bank %02X\n", bank)
+		}
+		if label, found := symbols.Lookup(bank, address); found {
+			fmt.Fprintf(w, "%s:\n", label)
+		}
+
+		if cdl != nil && cdl[offset]&CDL_CODE == 0 {
+			offset += disassembleData(w, rom, cdl, offset, symbols)
+			continue
+		}
+
+		read := func(addr uint16) uint8 {
+			if idx := offset + int(addr-address); idx < len(rom) && idx/0x4000 == bank {
+				return rom[idx]
+			}
+			return 0
+		}
+		instruction := Disassemble(read, address, bank, symbols)
+		fmt.Fprintf(w, "    %-24s ; %02X:%04X %s\n", instruction.Mnemonic, bank, address, hexString(instruction.Bytes))
+		offset += len(instruction.Bytes)
+	}
+}
+
+// Consecutive data bytes with the same usage are grouped into db lines of up
+// to 8 bytes. A line never crosses a label or bank boundary.
+func disassembleData(w io.Writer, rom []uint8, cdl []uint8, offset int, symbols SymbolTable) int {
+	bank, address := ROMAddress(offset)
+	kind := cdl[offset] &^ CDL_OPERAND
+	length := 1
+	for ; length < 8 && offset+length < len(rom); length++ {
+		next := offset + length
+		if next%0x4000 == 0 || cdl[next]&CDL_CODE != 0 || cdl[next]&^CDL_OPERAND != kind {
+			break
+		}
+		if _, found := symbols.Lookup(bank, address+uint16(length)); found {
+			break
+		}
+	}
+
+	values := make([]string, length)
+	for i := range values {
+		values[i] = fmt.Sprintf("$%02X", rom[offset+i])
+	}
+	fmt.Fprintf(w, "    %-24s ; %02X:%04X %s\n", "db "+strings.Join(values, ","), bank, address, describeCDLFlags(kind))
+	return length
+}
+
+func describeCDLFlags(flags uint8) string {
+	descriptions := []string{}
+	if flags&CDL_DATA != 0 {
+		descriptions = append(descriptions, "data")
+	}
+	if flags&CDL_DMA != 0 {
+		descriptions = append(descriptions, "dma")
+	}
+	if flags&CDL_TILE != 0 {
+		descriptions = append(descriptions, "tile")
+	}
+	if len(descriptions) == 0 {
+		return "unused"
+	}
+	return strings.Join(descriptions, ",")
+}
+
+func hexString(bytes []uint8) string {
+	hexBytes := make([]string, len(bytes))
+	for idx, b := range bytes {
+		hexBytes[idx] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hexBytes, " ")
+}
+
+func RunDisassembler(args []string) int {
+	flags := flag.NewFlagSet("disasm", flag.ExitOnError)
+	cdlFile := flags.String("cdl", "", "code/data log used to separate code from data")
+	symFile := flags.String("sym", "", "symbol file used to label addresses")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: gbemu disasm [options] <rom>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	rom, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Printf("ERROR opening ROM: %s\n", err)
+		return 2
+	}
+
+	symbols := CreateSymbolTable()
+	if *symFile != "" {
+		if symbols, err = LoadSymbolFile(*symFile); err != nil {
+			fmt.Println(err)
+			return 2
+		}
+	}
+
+	var cdl []uint8
+	if *cdlFile != "" {
+		logger, err := LoadCodeDataLog(*cdlFile, len(rom))
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		cdl = logger.Flags()
+	}
+
+	writer := bufio.NewWriter(os.Stdout)
+	DisassembleROM(writer, rom, cdl, symbols)
+	if err := writer.Flush(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,441 @@
+package gbemu
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const EMULATOR_VERSION string = "0.1.0"
+
+// Emulator is the public entry point for embedding the emulator in other
+// programs. Everything runs on the caller's goroutine, nothing is drawn or
+// read from any input device unless a FrameSink/InputSource is attached.
+type Emulator struct {
+	gameboy Gameboy
+	cpu     CPU
+	mmu     MMU
+	buttons ButtonState
+	input   InputSource
+	image   *image.RGBA
+	rom     ROMIdentity
+
+	recording     *Movie
+	playback      *Movie
+	playbackFrame int
+
+	rewind         RewindBuffer
+	rewindInterval int
+	rewindFrames   int
+	rewindWriter   StateWriter
+}
+
+// Options are all optional. Debugging aids are attached before the first
+// instruction is fetched so they see the whole run.
+type Options struct {
+	Symbols        SymbolTable
+	Profiler       Profiler
+	CodeDataLogger CodeDataLogger
+	Heatmap        Heatmap
+	FrameSinks     []FrameSink
+	InputSource    InputSource
+	RewindBudget   int // Memory for rewind snapshots in bytes, 0 disables rewinding
+	RewindInterval int // Frames between rewind snapshots
+	// Let the CPU access VRAM and OAM in every PPU mode. Some games only work
+	// on emulators that never locked them.
+	NoAccessBlocking bool
+}
+
+// RegisterState is a snapshot of the CPU registers
+type RegisterState struct {
+	A, F, B, C, D, E, H, L uint8
+	SP, PC                 uint16
+}
+
+func New(rom []byte, opts Options) (*Emulator, error) {
+	if len(rom) < 0x150 {
+		return nil, fmt.Errorf("ERROR ROM is only %d bytes, too small to contain a cartridge header", len(rom))
+	}
+
+	mmu := CreateMMU()
+	mmu.Reset()
+	mmu.InitRom(rom)
+	if opts.CodeDataLogger != nil {
+		mmu.SetCodeDataLogger(opts.CodeDataLogger)
+	}
+	if opts.Heatmap != nil {
+		mmu.SetHeatmap(opts.Heatmap)
+	}
+	if opts.NoAccessBlocking {
+		mmu.SetAccessBlocking(false)
+	}
+	setupBootLogo(mmu)
+
+	cpu := CreateCPU(mmu)
+	if opts.Symbols != nil {
+		cpu.SetSymbols(opts.Symbols)
+	}
+	if opts.Profiler != nil {
+		cpu.SetProfiler(opts.Profiler)
+	}
+	cpu.Reset()
+
+	gameboy := CreateGameboy(cpu, mmu, CreateTimer(mmu), CreateDisplay(mmu))
+	if opts.Heatmap != nil {
+		gameboy.AddFrameSink(opts.Heatmap)
+	}
+	for _, sink := range opts.FrameSinks {
+		gameboy.AddFrameSink(sink)
+	}
+	emulator := &Emulator{
+		gameboy: gameboy,
+		cpu:     cpu,
+		mmu:     mmu,
+		image:   image.NewRGBA(image.Rect(0, 0, SCREEN_WIDTH, SCREEN_HEIGHT)),
+		input:   opts.InputSource,
+		rom:     IdentifyROM(rom),
+	}
+	if opts.RewindBudget > 0 {
+		emulator.rewind = CreateRewindBuffer(opts.RewindBudget)
+		emulator.rewindInterval = opts.RewindInterval
+		if emulator.rewindInterval < 1 {
+			emulator.rewindInterval = 1
+		}
+	}
+	return emulator, nil
+}
+
+func NewFromFile(filename string, opts Options) (*Emulator, error) {
+	rom, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR opening ROM: %s", err)
+	}
+	return New(rom, opts)
+}
+
+// Step runs until the CPU has executed one instruction and returns the number
+// of clock cycles that took. Nothing runs once the CPU has crashed, see Err.
+func (e *Emulator) Step() int {
+	executed := e.cpu.InstructionsExecuted()
+	for cycles := 1; cycles <= TICKS_PER_REFRESH; cycles++ {
+		if e.cpu.Err() != nil {
+			return cycles - 1
+		}
+		e.gameboy.Tick()
+		if e.cpu.InstructionsExecuted() != executed {
+			return cycles
+		}
+	}
+	return TICKS_PER_REFRESH // The CPU is stopped or halted
+}
+
+// Err returns the error that crashed the CPU, e.g. an unknown opcode, or nil
+// while the game is running. Loading a save state clears it.
+func (e *Emulator) Err() error {
+	return e.cpu.Err()
+}
+
+// RunFrame applies the buttons for this frame then runs until the LCD has
+// finished drawing it or the CPU crashes, see Err
+func (e *Emulator) RunFrame() {
+	e.mmu.SetButtons(e.frameButtons())
+	e.gameboy.RunFrame()
+
+	if e.rewind != nil {
+		e.rewindFrames += 1
+		if e.rewindFrames >= e.rewindInterval {
+			e.rewindFrames = 0
+			e.rewindWriter.Reset()
+			e.snapshot(&e.rewindWriter)
+			e.rewind.Capture(e.rewindWriter.Bytes())
+		}
+	}
+}
+
+// Rewind steps back to the previous rewind snapshot and presents its frame.
+// It returns false when rewinding is disabled or nothing has been recorded.
+func (e *Emulator) Rewind() bool {
+	if e.rewind == nil || e.recording != nil || e.playback != nil {
+		return false
+	}
+	data, ok := e.rewind.Rewind()
+	if !ok {
+		return false
+	}
+	if err := e.restoreSnapshot(data); err != nil {
+		fmt.Println(err)
+		return false
+	}
+	e.rewindFrames = 0
+	e.gameboy.Display().Present()
+	return true
+}
+
+// RunCycles runs for n clock cycles (4.194304 MHz), or until the CPU crashes
+func (e *Emulator) RunCycles(n int) {
+	for i := 0; i < n && e.cpu.Err() == nil; i++ {
+		e.gameboy.Tick()
+	}
+}
+
+// Framebuffer returns the last frame drawn. The image is reused by the next
+// call so it must be copied if it needs to be kept.
+func (e *Emulator) Framebuffer() *image.RGBA {
+	e.gameboy.Display().Framebuffer().CopyToImage(e.image)
+	return e.image
+}
+
+// SetButtons replaces the set of held buttons. They take effect straight away
+// so Step and RunCycles see them too, except while a movie is recorded or
+// played back. Input then only changes at the start of a frame so the run can
+// be replayed exactly, and movies have to be driven with RunFrame.
+func (e *Emulator) SetButtons(state ButtonState) {
+	e.buttons = state
+	if e.recording == nil && e.playback == nil {
+		e.mmu.SetButtons(state)
+	}
+}
+
+// frameButtons works out the buttons held for the next frame, from the input
+// source or the movie being played back, and records them
+func (e *Emulator) frameButtons() ButtonState {
+	if e.input != nil {
+		for _, keyPress := range e.input.PollInput() {
+			e.buttons = e.buttons.With(keyPress.Button, keyPress.Pressed)
+		}
+	}
+
+	buttons := e.buttons
+	if e.playback != nil {
+		buttons = e.playback.Frames[e.playbackFrame]
+		e.playbackFrame += 1
+		if e.playbackFrame == len(e.playback.Frames) {
+			fmt.Printf("Movie finished after %d frames\n", e.playbackFrame)
+			e.playback = nil
+		}
+	}
+	if e.recording != nil {
+		e.recording.Frames = append(e.recording.Frames, buttons)
+	}
+	return buttons
+}
+
+// RecordMovie starts recording input. A movie started before anything has
+// run starts from power on, otherwise the current state is embedded in it.
+func (e *Emulator) RecordMovie() error {
+	movie := &Movie{EmulatorVersion: EMULATOR_VERSION, ROM: e.rom}
+	if e.cpu.InstructionsExecuted() != 0 {
+		var state bytes.Buffer
+		if err := e.SaveState(&state); err != nil {
+			return err
+		}
+		movie.StartState = state.Bytes()
+	}
+	e.recording = movie
+	return nil
+}
+
+// StopRecording returns the movie recorded since RecordMovie, or nil
+func (e *Emulator) StopRecording() *Movie {
+	movie := e.recording
+	e.recording = nil
+	return movie
+}
+
+// PlayMovie replaces input with the movie's until it ends. Movies that start
+// from power on can only be played on an emulator that hasn't run yet.
+func (e *Emulator) PlayMovie(movie *Movie) error {
+	if movie.ROM != e.rom {
+		return fmt.Errorf("ERROR movie was recorded with a different ROM (%q, CRC %08X)", movie.ROM.TitleString(), movie.ROM.Checksum)
+	}
+	if movie.EmulatorVersion != EMULATOR_VERSION {
+		fmt.Printf("WARNING movie was recorded with emulator version %s, this is %s\n", movie.EmulatorVersion, EMULATOR_VERSION)
+	}
+
+	if movie.StartState != nil {
+		if err := e.LoadState(bytes.NewReader(movie.StartState)); err != nil {
+			return err
+		}
+	} else if e.cpu.InstructionsExecuted() != 0 {
+		return fmt.Errorf("ERROR movie starts at power on but the emulator has already run")
+	}
+	if len(movie.Frames) > 0 {
+		e.playback = movie
+		e.playbackFrame = 0
+	}
+	return nil
+}
+
+// MoviePlaying is true until the last frame of the movie has been played
+func (e *Emulator) MoviePlaying() bool {
+	return e.playback != nil
+}
+
+func (e *Emulator) Buttons() ButtonState {
+	return e.buttons
+}
+
+// ReadMemory reads from the CPU address space without any side effects on the
+// debugging aids
+func (e *Emulator) ReadMemory(address uint16) uint8 {
+	return e.mmu.PeekAt(address)
+}
+
+// WriteMemory writes to the CPU address space even while the CPU itself is
+// locked out of VRAM/OAM
+func (e *Emulator) WriteMemory(address uint16, value uint8) {
+	e.mmu.PokeAt(address, value)
+}
+
+func (emulator *Emulator) Registers() RegisterState {
+	r := emulator.cpu.Registers()
+	return RegisterState{
+		A:  r.ReadRegister(a),
+		F:  r.ReadRegister(f),
+		B:  r.ReadRegister(b),
+		C:  r.ReadRegister(c),
+		D:  r.ReadRegister(d),
+		E:  r.ReadRegister(e),
+		H:  r.ReadRegister(h),
+		L:  r.ReadRegister(l),
+		SP: r.ReadSP(),
+		PC: r.ReadPC(),
+	}
+}
+
+func (e *Emulator) AddFrameSink(sink FrameSink) {
+	e.gameboy.AddFrameSink(sink)
+}
+
+func (e *Emulator) SetInputSource(input InputSource) {
+	e.input = input
+}
+
+func (e *Emulator) stateSections() ([]string, []Snapshotter) {
+	return []string{"CPU_", "MMU_", "TIMR", "LCD_"},
+		[]Snapshotter{e.cpu, e.mmu, e.gameboy.Timer(), e.gameboy.Display()}
+}
+
+// Snapshots are save states without the header and section framing, cheap
+// enough to take every few frames
+func (e *Emulator) snapshot(w *StateWriter) {
+	_, components := e.stateSections()
+	for _, component := range components {
+		component.SaveState(w)
+	}
+}
+
+// Snapshots only ever come from snapshot, so unlike save states they're loaded
+// straight into the running machine without building a scratch one first
+func (e *Emulator) restoreSnapshot(data []byte) error {
+	r := CreateStateReader(data)
+	_, components := e.stateSections()
+	for _, component := range components {
+		component.LoadState(r)
+	}
+	return r.Err()
+}
+
+// loadAtomically runs load on a scratch machine first and only loads into the
+// running one once that worked, so a bad state can't leave it half loaded
+func (e *Emulator) loadAtomically(load func([]Snapshotter) error) error {
+	mmu := CreateMMU()
+	scratch := []Snapshotter{CreateCPU(mmu), mmu, CreateTimer(mmu), CreateDisplay(mmu)}
+	if err := load(scratch); err != nil {
+		return err
+	}
+	_, components := e.stateSections()
+	return load(components)
+}
+
+// SaveState writes a snapshot of the whole machine, see savestate.go for the
+// format
+func (e *Emulator) SaveState(w io.Writer) error {
+	sections, components := e.stateSections()
+	return WriteSaveState(w, e.rom, sections, components)
+}
+
+// LoadState restores a snapshot taken with SaveState. The state is validated
+// first and the emulator is left untouched if it can't be loaded.
+func (e *Emulator) LoadState(r io.Reader) error {
+	if e.recording != nil || e.playback != nil {
+		return fmt.Errorf("ERROR can't load a state while a movie is being recorded or played")
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("ERROR reading save state: %s", err)
+	}
+	return e.loadAtomically(func(components []Snapshotter) error {
+		reader, err := ReadSaveState(bytes.NewReader(data), e.rom)
+		if err != nil {
+			return err
+		}
+		sections, _ := e.stateSections()
+		return reader.LoadSections(sections, components)
+	})
+}
+
+func (e *Emulator) SaveStateFile(filename string) error {
+	var buffer bytes.Buffer
+	if err := e.SaveState(&buffer); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filename, buffer.Bytes(), 0644); err != nil {
+		return fmt.Errorf("ERROR writing save state: %s", err)
+	}
+	return nil
+}
+
+func (e *Emulator) LoadStateFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("ERROR opening save state: %s", err)
+	}
+	defer f.Close()
+	return e.LoadState(f)
+}
+
+// CPU and MMU give access to the internals for tools such as the tracer
+func (e *Emulator) CPU() CPU {
+	return e.cpu
+}
+
+func (e *Emulator) MMU() MMU {
+	return e.mmu
+}
+
+// The boot ROM isn't emulated so the Nintendo logo it leaves in VRAM is set up
+// by hand from the cartridge header
+func setupBootLogo(m MMU) {
+	lookupTable := []byte{
+		0x00, 0x03, 0x0c, 0x0f, 0x30, 0x33, 0x3c, 0x3f,
+		0xc0, 0xc3, 0xcc, 0xcf, 0xf0, 0xf3, 0xfc, 0xff,
+	}
+
+	hdrTileData := []byte{}
+	for i := 0x104; i < 0x104+48; i++ {
+		value := m.PeekAt(uint16(i))
+		v1, v2 := lookupTable[value>>4], lookupTable[value&0x0f]
+		hdrTileData = append(hdrTileData, v1, 0, v1, 0, v2, 0, v2, 0)
+	}
+
+	hdrTileData = append(hdrTileData,
+		0x3c, 0x00, 0x42, 0x00, 0xb9, 0x00, 0xa5, 0x00, 0xb9, 0x00, 0xa5, 0x00, 0x42, 0x00, 0x3c, 0x00,
+	)
+
+	bootTileMap := []byte{
+		0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c,
+		0x19, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x0d, 0x0e, 0x0f, 0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18,
+	}
+
+	for i := range hdrTileData {
+		m.PokeAt(uint16(0x8010+i), hdrTileData[i])
+	}
+	for i := range bootTileMap {
+		m.PokeAt(uint16(0x9900+i), bootTileMap[i])
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package gbemu
 
 type FetchState int
 type FetchMode int
@@ -7,7 +7,7 @@ const (
 	TILE_READ FetchState = iota
 	READ_DATA_0
 	READ_DATA_1
-	IDLE
+	PUSH // Waiting for the PPU to take the pixels
 
 	BG_FETCH FetchMode = iota
 	SPRITE_FETCH
@@ -15,45 +15,51 @@ const (
 )
 
 type Fetcher interface {
-	Fetch(int) []RGBPixel
+	Fetch(int) bool
+	Pixels() *[8]fifoPixel
 	Reset(uint16, FetchMode, SpriteAttribute)
+	SetWindowLine(uint8)
+	Snapshotter
 }
 
 type fetcher struct {
-	currentState           FetchState
-	addresser              MemoryAddresser
-	mmu                    MMU
-	fetchMode              FetchMode
-	backgroundStartAddress uint16
-	windowStartAddress     uint16
-	currentTile            uint16
-	currentPixel           uint16
-	tileData               uint16
-	doAction               bool
-	pixels                 []RGBPixel
-	oamEntry               SpriteAttribute
+	currentState FetchState
+	addresser    MemoryAddresser
+	mmu          MMU
+	fetchMode    FetchMode
+	currentTile  uint16
+	currentPixel uint16 // Screen X for the background, window X for the window
+	tileData     uint16
+	tileLine     uint16 // Row within the tile, 0-7
+	windowLine   uint8
+	doAction     bool
+	pixels       [8]fifoPixel
+	oamEntry     SpriteAttribute
 }
 
 func createFetcher(mmu MMU) Fetcher {
 	return &fetcher{
-		currentState:           TILE_READ,
-		addresser:              CreateMemoryAddresser(mmu),
-		mmu:                    mmu,
-		fetchMode:              BG_FETCH,
-		backgroundStartAddress: mmu.BGTileMap(),
-		windowStartAddress:     mmu.WindowTileMap(),
-		currentPixel:           0,
-		currentTile:            0,
-		tileData:               0,
-		doAction:               false,
-		pixels:                 make([]RGBPixel, 8),
-		oamEntry:               nil,
+		currentState: TILE_READ,
+		addresser:    CreateMemoryAddresser(mmu),
+		mmu:          mmu,
+		fetchMode:    BG_FETCH,
+		currentPixel: 0,
+		currentTile:  0,
+		tileData:     0,
+		windowLine:   0,
+		doAction:     false,
+		oamEntry:     nil,
 	}
 }
 
-func (f *fetcher) Fetch(currentLine int) []RGBPixel {
+// Fetch runs one step and reports whether 8 pixels are ready. The fetcher
+// keeps them until it is Reset, so the PPU can wait for room in its FIFO.
+func (f *fetcher) Fetch(currentLine int) bool {
+	if f.currentState == PUSH {
+		return true
+	}
 	if !f.canRun() {
-		return nil
+		return false
 	}
 
 	switch f.currentState {
@@ -63,32 +69,38 @@ func (f *fetcher) Fetch(currentLine int) []RGBPixel {
 		f.readData(0, currentLine)
 	case READ_DATA_1:
 		f.readData(1, currentLine)
-	case IDLE:
 		f.setPixels()
 	}
 
 	f.currentState = f.nextState()
+	return f.currentState == PUSH
+}
 
-	if f.currentState == TILE_READ {
-		pixels := make([]RGBPixel, 8)
-		copy(pixels, f.pixels)
-		return pixels
-	}
-	return nil
+// Pixels are the last fetched pixels, only valid until the next Reset
+func (f *fetcher) Pixels() *[8]fifoPixel {
+	return &f.pixels
 }
 
 // Have reset take a param so that the ppu can tell it where to start fetching sprite pixels at
 func (f *fetcher) Reset(currentPixel uint16, fetchMode FetchMode, spriteAttrs SpriteAttribute) {
-	f.currentPixel = currentPixel % uint16(SCREEN_WIDTH)
+	f.currentState = TILE_READ
+	f.doAction = false
+	f.currentPixel = currentPixel
 	f.tileData = 0
 	f.currentTile = 0
 	f.oamEntry = spriteAttrs
 	f.fetchMode = fetchMode
 	for i := 0; i < len(f.pixels); i++ {
-		f.pixels[i] = WHITE()
+		f.pixels[i] = fifoPixel{}
 	}
 }
 
+// SetWindowLine sets the PPU's internal window line counter, which only
+// advances on lines where the window was drawn
+func (f *fetcher) SetWindowLine(line uint8) {
+	f.windowLine = line
+}
+
 func (f *fetcher) nextState() FetchState {
 	switch f.currentState {
 	case TILE_READ:
@@ -96,36 +108,39 @@ func (f *fetcher) nextState() FetchState {
 	case READ_DATA_0:
 		return READ_DATA_1
 	case READ_DATA_1:
-		return IDLE
-	case IDLE:
-		return TILE_READ
+		return PUSH
+	case PUSH:
+		return PUSH
 	default:
-		return IDLE
+		return PUSH
 	}
 }
 
 func (f *fetcher) readTile(currentLine int) {
+	f.tileLine = uint16(currentLine & 0x07)
 	if f.fetchMode == BG_FETCH {
-		yOffset, xOffset := uint16(currentLine>>3), uint16(f.currentPixel>>3)
-		f.currentTile = uint16(f.mmu.ReadAt(f.backgroundStartAddress + yOffset*32 + xOffset))
+		// SCY selects the tile row and the line within it, the coarse part of
+		// SCX the tile column. The fine part of SCX is dropped by the PPU at
+		// the start of the line. The 32x32 tile map wraps around both ways.
+		y := (currentLine + int(f.mmu.ScrollY())) & 0xFF
+		yOffset := uint16(y>>3) & 31
+		xOffset := (uint16(f.currentPixel>>3) + uint16(f.mmu.ScrollX()>>3)) & 31
+		f.tileLine = uint16(y & 0x07)
+		f.currentTile = uint16(f.mmu.ReadVideoMemory(f.mmu.BGTileMap() + yOffset*32 + xOffset))
 	} else if f.fetchMode == WINDOW_FETCH {
-		y := currentLine - int(f.mmu.WindowYPosition())
-
-		xStart := int(f.mmu.WindowXPosition()) - 7
-		x := int(f.currentPixel) - xStart
-
-		yOffset, xOffset := uint16(y>>3), uint16(x>>3)
-		f.currentTile = uint16(f.mmu.ReadAt(f.windowStartAddress + yOffset*32 + xOffset))
+		yOffset, xOffset := uint16(f.windowLine>>3), uint16(f.currentPixel>>3)&31
+		f.tileLine = uint16(f.windowLine & 0x07)
+		f.currentTile = uint16(f.mmu.ReadVideoMemory(f.mmu.WindowTileMap() + yOffset*32 + xOffset))
 	} else if f.fetchMode == SPRITE_FETCH {
-		yOffset, xOffset := uint16(currentLine-f.oamEntry.GetYPosition()), uint16(int(f.currentPixel)-f.oamEntry.GetXPosition())
+		// Y in OAM is the sprite's top line + 16
+		yOffset := uint16(currentLine + 16 - f.oamEntry.GetYPosition())
 
-		if f.oamEntry.HorizontalFlip() {
-			xOffset = 7 - xOffset
+		height := uint16(8)
+		if f.mmu.SpriteSize() == 1 {
+			height = 16
 		}
-
-		height := f.mmu.SpriteSize()
 		if f.oamEntry.VerticalFlip() {
-			yOffset = uint16(height) - 1 - yOffset
+			yOffset = height - 1 - yOffset
 		}
 
 		tileNum := f.oamEntry.GetTileNumber()
@@ -136,13 +151,14 @@ func (f *fetcher) readTile(currentLine int) {
 			}
 		}
 		f.currentTile = uint16(tileNum)
+		f.tileLine = yOffset & 0x07
 	}
 }
 
 func (f *fetcher) readData(byteNum uint8, currentLine int) {
-	lineOffset := uint16((currentLine & 0x07) << 1)
+	lineOffset := f.tileLine << 1
 	memoryAddr := f.addresser.GetAddress(uint8(f.currentTile), f.fetchMode) + uint16(byteNum) + lineOffset
-	value := f.mmu.ReadAt(memoryAddr)
+	value := f.mmu.ReadVideoMemory(memoryAddr)
 	f.tileData += uint16(value) << (8 * byteNum)
 }
 
@@ -150,22 +166,35 @@ func (f *fetcher) setPixels() {
 	for i := 0; i < len(f.pixels); i++ {
 		if f.fetchMode == BG_FETCH || f.fetchMode == WINDOW_FETCH {
 			f.pixels[i] = f.getBgColor(7 - i) // The leftmost pixel corresponds to bit 7
+		} else if f.fetchMode == SPRITE_FETCH && f.oamEntry.HorizontalFlip() {
+			f.pixels[i] = f.getSpriteColor(i)
 		} else if f.fetchMode == SPRITE_FETCH {
 			f.pixels[i] = f.getSpriteColor(7 - i) // The leftmost pixel corresponds to bit 7
 		}
 	}
 }
 
-func (f *fetcher) getBgColor(i int) RGBPixel {
+func (f *fetcher) getBgColor(i int) fifoPixel {
 	lowerBit := GetBitUint16(f.tileData, uint(i))
 	upperBit := GetBitUint16(f.tileData, uint(i+8))
-	return f.mmu.ConvertNumToBgPixel(BitsToNum(lowerBit, upperBit))
+	colorIndex := BitsToNum(upperBit, lowerBit)
+	source := SOURCE_BACKGROUND
+	if f.fetchMode == WINDOW_FETCH {
+		source = SOURCE_WINDOW
+	}
+	return fifoPixel{colorIndex: uint8(colorIndex), source: source}
 }
 
-func (f *fetcher) getSpriteColor(i int) RGBPixel {
+func (f *fetcher) getSpriteColor(i int) fifoPixel {
 	lowerBit := GetBitUint16(f.tileData, uint(i))
 	upperBit := GetBitUint16(f.tileData, uint(i+8))
-	return f.mmu.ConvertNumToSpritePixel(BitsToNum(lowerBit, upperBit), f.oamEntry.PaletteNumber())
+	colorIndex := BitsToNum(upperBit, lowerBit)
+	return fifoPixel{
+		colorIndex: uint8(colorIndex),
+		palette:    uint8(f.oamEntry.PaletteNumber()),
+		bgPriority: !f.oamEntry.HasPriority(),
+		source:     SOURCE_SPRITE,
+	}
 }
 
 // Method to run fetcher at half speed
@@ -174,3 +203,33 @@ func (f *fetcher) canRun() bool {
 	f.doAction = !f.doAction
 	return oldValue
 }
+
+func (f *fetcher) SaveState(w *StateWriter) {
+	w.WriteInt(int(f.currentState))
+	w.WriteInt(int(f.fetchMode))
+	w.WriteUint16(f.currentTile)
+	w.WriteUint16(f.currentPixel)
+	w.WriteUint16(f.tileData)
+	w.WriteUint16(f.tileLine)
+	w.WriteUint8(f.windowLine)
+	w.WriteBool(f.doAction)
+	for _, pixel := range f.pixels {
+		writeFifoPixel(w, pixel)
+	}
+	writeSpriteAttribute(w, f.oamEntry)
+}
+
+func (f *fetcher) LoadState(r *StateReader) {
+	f.currentState = FetchState(r.ReadInt())
+	f.fetchMode = FetchMode(r.ReadInt())
+	f.currentTile = r.ReadUint16()
+	f.currentPixel = r.ReadUint16()
+	f.tileData = r.ReadUint16()
+	f.tileLine = r.ReadUint16()
+	f.windowLine = r.ReadUint8()
+	f.doAction = r.ReadBool()
+	for i := range f.pixels {
+		f.pixels[i] = readFifoPixel(r)
+	}
+	f.oamEntry = readSpriteAttribute(r)
+}
@@ -0,0 +1,94 @@
+package gbemu
+
+import "testing"
+
+// Row 1 of tile 0 is 0 0 2 2 1 1 3 3, row 1 of tile 1 is 3 3 1 1 2 2 0 0
+func setupTestTiles(m MMU) {
+	m.PokeAt(0x8002, 0x0F)
+	m.PokeAt(0x8003, 0x33)
+	m.PokeAt(0x8012, 0xF0)
+	m.PokeAt(0x8013, 0xCC)
+}
+
+func TestFetcherColorIndices(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   FetchMode
+		sprite SpriteAttribute
+		want   [8]uint8
+	}{
+		{"background", BG_FETCH, nil, [8]uint8{0, 0, 2, 2, 1, 1, 3, 3}},
+		{"sprite", SPRITE_FETCH, fromBytes([]uint8{16, 8, 1, 0x00}), [8]uint8{3, 3, 1, 1, 2, 2, 0, 0}},
+		{"flipped sprite", SPRITE_FETCH, fromBytes([]uint8{16, 8, 1, 0x20}), [8]uint8{0, 0, 2, 2, 1, 1, 3, 3}},
+	}
+
+	for _, test := range tests {
+		m := CreateMMU()
+		m.Reset()
+		setupTestTiles(m)
+		f := createFetcher(m)
+		f.Reset(0, test.mode, test.sprite)
+		for i := 0; !f.Fetch(1); i++ {
+			if i == 16 {
+				t.Fatalf("%s: fetcher never finished", test.name)
+			}
+		}
+
+		var got [8]uint8
+		for i, pixel := range f.Pixels() {
+			got[i] = pixel.colorIndex
+		}
+		if got != test.want {
+			t.Errorf("%s: colour indices = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// renderLine1 draws line 1 with tile 0 as the background and returns the
+// first 16 pixels
+func renderLine1(bgp, obp0 uint8, sprite bool) []RGBPixel {
+	m := CreateMMU()
+	m.Reset()
+	d := CreateDisplay(m)
+	setupTestTiles(m)
+	m.WriteByte(BG_WINDOW_PALLETTE_DATA, bgp)
+	m.WriteByte(OBJECT_PALLETTE_0, obp0)
+	m.WriteByte(LCD_CONTROL, 0x93)
+	if sprite {
+		m.PokeAt(0xFE00, 16)
+		m.PokeAt(0xFE01, 16) // Second tile on screen
+		m.PokeAt(0xFE02, 1)
+	}
+
+	for d.CurrentLine() != 2 {
+		d.Tick()
+	}
+	return d.Framebuffer()[1][:16]
+}
+
+func TestRenderTileRow(t *testing.T) {
+	w, l, d, b := WHITE(), LIGHT_GRAY(), DARK_GRAY(), BLACK()
+	tests := []struct {
+		name   string
+		bgp    uint8
+		obp0   uint8
+		sprite bool
+		want   []RGBPixel
+	}{
+		{"identity palette", 0xE4, 0xE4, false, []RGBPixel{w, w, d, d, l, l, b, b, w, w, d, d, l, l, b, b}},
+		{"inverted palette", 0x1B, 0xE4, false, []RGBPixel{b, b, l, l, d, d, w, w, b, b, l, l, d, d, w, w}},
+		{"colours 1 and 2 only", 0x24, 0xE4, false, []RGBPixel{w, w, d, d, l, l, w, w, w, w, d, d, l, l, w, w}},
+		// Sprite colour 0 shows the background
+		{"sprite", 0xE4, 0xE4, true, []RGBPixel{w, w, d, d, l, l, b, b, b, b, l, l, d, d, b, b}},
+		{"sprite palette", 0xE4, 0x1B, true, []RGBPixel{w, w, d, d, l, l, b, b, w, w, d, d, l, l, b, b}},
+	}
+
+	for _, test := range tests {
+		got := renderLine1(test.bgp, test.obp0, test.sprite)
+		for x := range test.want {
+			if got[x] != test.want[x] {
+				t.Errorf("%s: pixel %d = %v, want %v", test.name, x, got[x], test.want[x])
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package gbemu
+
+// The Gameboy ties the CPU, MMU, timer and LCD together without knowing
+// anything about how frames are shown or where input comes from, so the same
+// core runs behind a window or headless.
+type Gameboy interface {
+	Tick()
+	RunFrame()
+	CPU() CPU
+	MMU() MMU
+	Timer() Timer
+	Display() Display
+	AddFrameSink(FrameSink)
+}
+
+type gameboy struct {
+	cpu     CPU
+	mmu     MMU
+	timer   Timer
+	display Display
+}
+
+func CreateGameboy(cpu CPU, mmu MMU, timer Timer, display Display) Gameboy {
+	return &gameboy{
+		cpu:     cpu,
+		mmu:     mmu,
+		timer:   timer,
+		display: display,
+	}
+}
+
+func (g *gameboy) Tick() {
+	g.cpu.Tick()
+	g.mmu.Tick()
+	g.timer.Tick()
+	g.display.Tick()
+}
+
+// RunFrame runs until the LCD finishes a frame. With the LCD turned off no
+// frame is ever finished so it gives up after the number of ticks a frame
+// would have taken. It also stops early if the CPU crashes.
+func (g *gameboy) RunFrame() {
+	for i := 0; i < TICKS_PER_REFRESH; i++ {
+		g.Tick()
+		if g.display.FrameReady() || g.cpu.Err() != nil {
+			return
+		}
+	}
+}
+
+func (g *gameboy) CPU() CPU {
+	return g.cpu
+}
+
+func (g *gameboy) MMU() MMU {
+	return g.mmu
+}
+
+func (g *gameboy) Timer() Timer {
+	return g.timer
+}
+
+func (g *gameboy) Display() Display {
+	return g.display
+}
+
+func (g *gameboy) AddFrameSink(sink FrameSink) {
+	g.display.AddFrameSink(sink)
+}
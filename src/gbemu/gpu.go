@@ -1,11 +1,9 @@
-package main
+package gbemu
 
 import (
-	"fmt"
+	"image"
+	"image/color"
 	"sort"
-
-	"github.com/go-gl/gl/v2.1/gl"
-	"github.com/go-gl/glfw/v3.3/glfw"
 )
 
 const (
@@ -15,21 +13,28 @@ const (
 	VBLANK_MODE         uint8 = 1
 	OAM_SEARCH_MODE     uint8 = 2
 	PIXEL_TRANSFER_MODE uint8 = 3
+	TICKS_PER_LINE      int   = 456
+	OAM_SEARCH_TICKS    int   = 80
+	LAST_VBLANK_LINE    int   = 153
+	// LY already reads 0 this many dots into line 153
+	LY_153_RESET_TICKS int = 4
+	// The first line after the LCD is switched on is this many dots shorter
+	LCD_ON_SHORT_LINE_TICKS int = 4
 )
 
 type display struct {
-	window         *glfw.Window
 	mmu            MMU
 	ppu            PPU
 	addresser      MemoryAddresser
 	currentTicks   int
 	lY             int
 	visibleSprites []SpriteAttribute
-}
-
-type KeyPress struct {
-	Key    glfw.Key
-	Action glfw.Action
+	frameSinks     []FrameSink
+	frameReady     bool
+	statLine       bool // The STAT interrupt line, interrupts fire on its rising edge
+	lcdOn          bool
+	lcdStarting    bool // First line after switching the LCD on, which has no OAM search
+	skipFrame      bool // The first frame after switching the LCD on isn't shown
 }
 
 type RGBPixel struct {
@@ -38,11 +43,22 @@ type RGBPixel struct {
 	Blue  uint8
 }
 
+type Framebuffer [SCREEN_HEIGHT][SCREEN_WIDTH]RGBPixel
+
+// FrameSinks receive every frame once the PPU has finished drawing it. The
+// framebuffer is only valid until the call returns.
+type FrameSink interface {
+	PresentFrame(*Framebuffer)
+}
+
 type Display interface {
-	Render()
 	Tick()
-	Start()
-	CurrentLine()
+	CurrentLine() int
+	Framebuffer() *Framebuffer
+	AddFrameSink(FrameSink)
+	FrameReady() bool
+	Present()
+	Snapshotter
 }
 
 // Notes:
@@ -51,15 +67,18 @@ type Display interface {
 //			* search for sprites that are visible on this line
 //			* oam.x != 0 && LY + 16 >= oam.y && LY + 16 < oam.y
 //		- 2. Pixel transfer - 43+ clocks (can be more depending on window and pixels drawn)
+//			* Its length isn't counted, it ends whenever the PPU has shifted out
+//			  the 160th pixel: 172 dots plus SCX & 7, 6 per window start and
+//			  6-11 per sprite
 //			* Shifts out one pixel per (4 mHZ) clock from the PPU
 //			* Needs to also store the source of the pixel to determine priority
 //			* Lower numbered sprites > higher sprites > background
 //			* Fetches the next 8 pixels at half speed
-//			* Fetches take 4 steps
+//			* Fetches take 3 steps and then push
 //				- 1. Read tile number
 //				- 2. Read byte 1
 //				- 3. Read byte 2
-//				- 4. Idle until the last 8 bits in the PPU are empty
+//				- 4. Wait until the background FIFO is empty and push 8 pixels
 //			* Windows cause the PPU to be totally reset and to start fetching from that window location
 //			* When a sprite is encountered it's pixels are overlaid onto the first 8 pixels in the PPU
 //		- 3. H-Blank - 51- clocks (Extra clocks in pixel transfer are taken out of H-Blank)
@@ -68,6 +87,21 @@ type Display interface {
 //		... Repeats 10 times
 //		- 5. Goes back to mode 1
 
+func (f *Framebuffer) Image() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, SCREEN_WIDTH, SCREEN_HEIGHT))
+	f.CopyToImage(img)
+	return img
+}
+
+func (f *Framebuffer) CopyToImage(img *image.RGBA) {
+	for y := 0; y < SCREEN_HEIGHT; y++ {
+		for x := 0; x < SCREEN_WIDTH; x++ {
+			pixel := f[y][x]
+			img.SetRGBA(x, y, color.RGBA{R: pixel.Red, G: pixel.Green, B: pixel.Blue, A: 0xFF})
+		}
+	}
+}
+
 // The 4 methods below are intended to be used as constants
 func WHITE() RGBPixel {
 	return RGBPixel{255, 255, 255}
@@ -85,90 +119,58 @@ func BLACK() RGBPixel {
 	return RGBPixel{0, 0, 0}
 }
 
-func CreateDisplay(mmu MMU, cpu CPU, timer Timer) {
-	err := glfw.Init()
-	if err != nil {
-		fmt.Println(err)
-	}
-	defer glfw.Terminate()
-
-	if err := gl.Init(); err != nil {
-		fmt.Println(err)
-	}
-
-	window, err := glfw.CreateWindow(SCREEN_WIDTH, SCREEN_HEIGHT, "GB Emulator", nil, nil)
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	window.MakeContextCurrent()
-
-	gl.Viewport(0, 0, int32(SCREEN_WIDTH), int32(SCREEN_HEIGHT))
-	gl.MatrixMode(gl.PROJECTION)
-	gl.LoadIdentity()
-	gl.Ortho(0, float64(SCREEN_WIDTH), float64(SCREEN_HEIGHT), 0, -1, 1)
-	gl.ClearColor(0.255, 0.255, 0.255, 0)
-	gl.Clear(gl.COLOR_BUFFER_BIT)
-	gl.MatrixMode(gl.MODELVIEW)
-	gl.LoadIdentity()
-	// TODO: Hook this up to the joypad register
-	callback := func(_ *glfw.Window, key glfw.Key, scancode int, action glfw.Action, modifier glfw.ModifierKey) {
-		mmu.AddKeyPressEvent(KeyPress{key, action})
-	}
-	window.SetKeyCallback(callback)
-	window.SetPos(0, 0)
-
-	d := &display{
-		window:         window,
+func CreateDisplay(mmu MMU) Display {
+	return &display{
 		mmu:            mmu,
 		addresser:      CreateMemoryAddresser(mmu),
 		ppu:            createPPU(mmu),
 		currentTicks:   0,
 		lY:             0,
 		visibleSprites: make([]SpriteAttribute, 10),
+		frameSinks:     make([]FrameSink, 0),
+		frameReady:     false,
+		lcdOn:          true,
 	}
-	d.Simulate(cpu, mmu, timer)
 }
 
-func (d *display) Render() {
-	gl.Clear(gl.COLOR_BUFFER_BIT)
-	gl.Disable(gl.DEPTH_TEST)
-	gl.PointSize(1.0)
-	gl.Begin(gl.POINTS)
-	for y := 0; y < SCREEN_HEIGHT; y++ {
-		for x := 0; x < SCREEN_WIDTH; x++ {
-			pixel := d.ppu.LcdBuffer(y, x)
-			gl.Color3ub(pixel.Red, pixel.Green, pixel.Blue)
-			gl.Vertex2i(int32(x), int32(y))
-		}
-	}
-	gl.End()
-	d.window.SwapBuffers()
+func (d *display) AddFrameSink(sink FrameSink) {
+	d.frameSinks = append(d.frameSinks, sink)
 }
 
-func (d *display) Simulate(cpu CPU, mmu MMU, timer Timer) {
-	for {
-		cpu.Tick()
-		mmu.Tick()
-		timer.Tick()
-		d.Tick()
-	}
+func (d *display) Framebuffer() *Framebuffer {
+	return d.ppu.Framebuffer()
+}
+
+// FrameReady reports whether a frame was completed since the last call
+func (d *display) FrameReady() bool {
+	ready := d.frameReady
+	d.frameReady = false
+	return ready
 }
 
+// Every line is 456 dots. Mode 2 and 3 take as long as they take and HBlank
+// lasts for the rest of the line.
 func (d *display) Tick() {
 	if !d.mmu.LCDEnabled() {
-		d.lY = 0
+		if d.lcdOn {
+			d.switchOff()
+		}
 		return
+	} else if !d.lcdOn {
+		d.switchOn()
 	}
 
 	switch d.mode() {
+	case HBLANK_MODE:
+		if d.lcdStarting && d.currentTicks == OAM_SEARCH_TICKS-1 {
+			d.lcdStarting = false
+			d.visibleSprites = d.visibleSprites[:0]
+			d.mmu.SetLCDStatusMode(PIXEL_TRANSFER_MODE)
+		}
 	case OAM_SEARCH_MODE:
-		if d.currentTicks == 80 {
+		if d.currentTicks == OAM_SEARCH_TICKS-1 {
 			d.readOam()
 			d.mmu.SetLCDStatusMode(PIXEL_TRANSFER_MODE)
-			d.currentTicks = 0
-		} else {
-			d.currentTicks += 1
 		}
 	case PIXEL_TRANSFER_MODE:
 		d.ppu.Tick(d.visibleSprites, d.lY)
@@ -176,46 +178,114 @@ func (d *display) Tick() {
 			d.mmu.SetLCDStatusMode(HBLANK_MODE)
 			d.ppu.Reset()
 		}
-		d.currentTicks += 1
-	case HBLANK_MODE:
-		if d.currentTicks == 376 {
-			if d.lY == SCREEN_HEIGHT-1 {
-				d.mmu.SetLCDStatusMode(VBLANK_MODE)
-				d.updateLY(d.lY + 1)
-				d.currentTicks = 0
-				d.mmu.FireInterrupt(VBLANK_INTERRUPT)
-			} else {
-				d.updateLY(d.lY + 1)
-				d.mmu.SetLCDStatusMode(OAM_SEARCH_MODE)
-				d.currentTicks = 0
-			}
-		} else {
-			d.currentTicks += 1
+	}
+
+	d.currentTicks += 1
+	if d.currentTicks == TICKS_PER_LINE {
+		d.currentTicks = 0
+		d.nextLine()
+	} else if d.lY == LAST_VBLANK_LINE && d.currentTicks == LY_153_RESET_TICKS {
+		d.mmu.WriteIORegister(LCDC_Y_COORDINATE, 0)
+	}
+	d.mmu.SetLineDot(d.currentTicks)
+	d.updateStatInterrupt()
+}
+
+// All enabled STAT sources are ORed into a single interrupt line and the
+// interrupt only fires when that line goes from low to high, so e.g. an LYC
+// match right after an HBlank interrupt on the same line doesn't fire again.
+//
+// On the DMG writing to STAT briefly enables every source, so a write during
+// HBlank, VBlank or while LY=LYC fires an interrupt some games rely on.
+func (d *display) updateStatInterrupt() {
+	stat := d.mmu.ReadIORegister(LCDC_STATUS)
+	coincidence := d.mmu.ReadIORegister(LCDC_Y_COORDINATE) == d.mmu.ReadIORegister(LY_COMPARE)
+	d.mmu.SetLYCoincidence(coincidence)
+
+	mode := stat & 0x03
+	line := (mode == HBLANK_MODE && stat&0x08 != 0) ||
+		(mode == VBLANK_MODE && stat&0x10 != 0) ||
+		(mode == OAM_SEARCH_MODE && stat&0x20 != 0) ||
+		(coincidence && stat&0x40 != 0)
+	if d.mmu.STATWritten() && (mode == HBLANK_MODE || mode == VBLANK_MODE || coincidence) {
+		line = true
+	}
+
+	if line && !d.statLine {
+		d.mmu.FireInterrupt(LCDC_STATUS_INTERRUPT)
+	}
+	d.statLine = line
+}
+
+// While the LCD is off LY stays 0, STAT reports HBlank and the screen is
+// blank
+func (d *display) switchOff() {
+	d.lcdOn = false
+	d.lcdStarting = false
+	d.currentTicks = 0
+	d.statLine = false
+	d.updateLY(0)
+	d.mmu.SetLCDStatusMode(HBLANK_MODE)
+	d.ppu.Reset()
+
+	frame := d.ppu.Framebuffer()
+	for y := range frame {
+		for x := range frame[y] {
+			frame[y][x] = WHITE()
 		}
-	case VBLANK_MODE:
-		if d.currentTicks == 456 {
-			if d.lY == SCREEN_HEIGHT+9 {
-				d.mmu.SetLCDStatusMode(OAM_SEARCH_MODE)
-				d.currentTicks = 0
-				d.updateLY(0)
-				d.updateDisplay()
-			} else {
-				d.updateLY(d.lY + 1)
-				d.currentTicks = 0
-			}
+	}
+	d.Present()
+}
+
+// Switching the LCD on starts line 0 straight away, but in HBlank instead of
+// the OAM search and a few dots short. The frame drawn then is thrown away.
+// STAT writes made while the LCD was off don't trigger the STAT write bug.
+func (d *display) switchOn() {
+	d.mmu.STATWritten()
+	d.lcdOn = true
+	d.lcdStarting = true
+	d.skipFrame = true
+	d.currentTicks = LCD_ON_SHORT_LINE_TICKS
+}
+
+func (d *display) nextLine() {
+	if d.mode() == PIXEL_TRANSFER_MODE {
+		// Only possible when the PPU gets stuck, don't let it carry over
+		d.ppu.Reset()
+	}
+
+	switch {
+	case d.lY == SCREEN_HEIGHT-1:
+		d.mmu.SetLCDStatusMode(VBLANK_MODE)
+		d.updateLY(d.lY + 1)
+		d.mmu.FireInterrupt(VBLANK_INTERRUPT)
+		if d.skipFrame {
+			d.skipFrame = false
+			d.frameReady = true
 		} else {
-			d.currentTicks += 1
+			d.presentFrame()
 		}
+	case d.lY == LAST_VBLANK_LINE:
+		d.mmu.SetLCDStatusMode(OAM_SEARCH_MODE)
+		d.updateLY(0)
+	case d.lY >= SCREEN_HEIGHT:
+		d.updateLY(d.lY + 1)
+	default:
+		d.mmu.SetLCDStatusMode(OAM_SEARCH_MODE)
+		d.updateLY(d.lY + 1)
 	}
 }
 
-func (d *display) updateDisplay() {
-	if d.window.ShouldClose() {
-		return
+func (d *display) presentFrame() {
+	d.Present()
+	d.frameReady = true
+}
+
+// Present shows the current framebuffer again, e.g. after restoring a state
+func (d *display) Present() {
+	for _, sink := range d.frameSinks {
+		sink.PresentFrame(d.ppu.Framebuffer())
 	}
-	d.Render()
-	d.window.SwapBuffers()
-	glfw.PollEvents()
 }
 
 func (d *display) mode() uint8 {
@@ -223,16 +293,16 @@ func (d *display) mode() uint8 {
 }
 
 func (d *display) readOam() {
-	d.visibleSprites = nil
+	d.visibleSprites = d.visibleSprites[:0]
 	for i := 0; i < 40; i++ {
-		byte0 := d.mmu.ReadAt(uint16(0xFE00 + i*4))
-		byte1 := d.mmu.ReadAt(uint16(0xFE00 + i*4 + 1))
-		byte2 := d.mmu.ReadAt(uint16(0xFE00 + i*4 + 2))
-		byte3 := d.mmu.ReadAt(uint16(0xFE00 + i*4 + 3))
-		attr := fromBytes([]uint8{byte0, byte1, byte2, byte3})
-
-		if d.lY >= attr.GetYPosition()-16 && d.lY < attr.GetYPosition()-16+d.spriteHeight() {
-			d.visibleSprites = append(d.visibleSprites, attr)
+		// Y is the sprite's top line + 16, so sprites can be partially above
+		// the screen. Sprites with X = 0 are hidden but still count.
+		y := int(d.mmu.ReadVideoMemory(uint16(0xFE00 + i*4)))
+		if d.lY+16 >= y && d.lY+16 < y+d.spriteHeight() {
+			byte1 := d.mmu.ReadVideoMemory(uint16(0xFE00 + i*4 + 1))
+			byte2 := d.mmu.ReadVideoMemory(uint16(0xFE00 + i*4 + 2))
+			byte3 := d.mmu.ReadVideoMemory(uint16(0xFE00 + i*4 + 3))
+			d.visibleSprites = append(d.visibleSprites, fromBytes([]uint8{uint8(y), byte1, byte2, byte3}))
 		}
 
 		// Only Store the first 10 sprites to be rendered
@@ -241,6 +311,7 @@ func (d *display) readOam() {
 		}
 	}
 
+	// Smaller X wins, ties go to the lower OAM index
 	sort.Stable(SortableSpriteAttribute(d.visibleSprites))
 }
 
@@ -259,10 +330,35 @@ func (d *display) CurrentLine() int {
 
 func (d *display) updateLY(newValue int) {
 	d.lY = newValue
-	d.mmu.WriteByte(LCDC_Y_COORDINATE, uint8(d.lY))
-	if uint8(d.lY) == d.mmu.ReadAt(LY_COMPARE) {
-		d.mmu.WriteByte(LCDC_STATUS, d.mmu.ReadAt(LCDC_STATUS)|0x04)
-	} else {
-		d.mmu.WriteByte(LCDC_STATUS, d.mmu.ReadAt(LCDC_STATUS)&0xFB)
+	d.mmu.WriteIORegister(LCDC_Y_COORDINATE, uint8(d.lY))
+}
+
+func (d *display) SaveState(w *StateWriter) {
+	w.WriteInt(d.currentTicks)
+	w.WriteInt(d.lY)
+	w.WriteBool(d.frameReady)
+	w.WriteBool(d.statLine)
+	w.WriteBool(d.lcdOn)
+	w.WriteBool(d.lcdStarting)
+	w.WriteBool(d.skipFrame)
+	w.WriteInt(len(d.visibleSprites))
+	for _, sprite := range d.visibleSprites {
+		writeSpriteAttribute(w, sprite)
+	}
+	d.ppu.SaveState(w)
+}
+
+func (d *display) LoadState(r *StateReader) {
+	d.currentTicks = r.ReadInt()
+	d.lY = r.ReadInt()
+	d.frameReady = r.ReadBool()
+	d.statLine = r.ReadBool()
+	d.lcdOn = r.ReadBool()
+	d.lcdStarting = r.ReadBool()
+	d.skipFrame = r.ReadBool()
+	d.visibleSprites = make([]SpriteAttribute, r.ReadCount(10))
+	for i := range d.visibleSprites {
+		d.visibleSprites[i] = readSpriteAttribute(r)
 	}
+	d.ppu.LoadState(r)
 }
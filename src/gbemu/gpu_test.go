@@ -0,0 +1,82 @@
+package gbemu
+
+import "testing"
+
+func TestSTATWriteWhileLCDOff(t *testing.T) {
+	m := CreateMMU()
+	m.Reset()
+	d := CreateDisplay(m)
+	d.Tick()
+
+	m.WriteByte(LCD_CONTROL, 0x11)
+	d.Tick()
+	m.WriteByte(LCDC_STATUS, 0x00)
+	d.Tick()
+	m.WriteByte(INTERRUPT_FLAGS, 0x00)
+	m.WriteByte(LCD_CONTROL, 0x91)
+	for i := 0; i < TICKS_PER_LINE; i++ {
+		d.Tick()
+	}
+	if m.ReadAt(INTERRUPT_FLAGS)&(1<<uint(LCDC_STATUS_INTERRUPT)) != 0 {
+		t.Errorf("STAT written while the LCD was off fired a STAT interrupt after switching it on")
+	}
+}
+
+// mode3Length measures mode 3 on line 1 with sprites at the given OAM X
+// positions covering that line
+func mode3Length(scx uint8, spriteXs []uint8) int {
+	m := CreateMMU()
+	m.Reset()
+	d := CreateDisplay(m)
+	m.WriteByte(SCROLL_X, scx)
+	m.WriteByte(LCD_CONTROL, 0x93)
+	for i, x := range spriteXs {
+		m.PokeAt(uint16(0xFE00+i*4), 16)
+		m.PokeAt(uint16(0xFE00+i*4+1), x)
+	}
+
+	for d.CurrentLine() != 1 || m.LCDStatusMode() != PIXEL_TRANSFER_MODE {
+		d.Tick()
+	}
+	dots := 0
+	for m.LCDStatusMode() == PIXEL_TRANSFER_MODE {
+		d.Tick()
+		dots++
+	}
+	return dots
+}
+
+func TestMode3Length(t *testing.T) {
+	tests := []struct {
+		name     string
+		scx      uint8
+		spriteXs []uint8
+		want     int
+	}{
+		{"no scroll", 0, nil, 172},
+		{"SCX 1", 1, nil, 173},
+		{"SCX 5", 5, nil, 177},
+		{"SCX 7", 7, nil, 179},
+		{"SCX 8 is a whole tile", 8, nil, 172},
+		{"SCX 0x53", 0x53, nil, 175},
+		{"sprite at X 0", 0, []uint8{0}, 183},
+		{"sprite aligned with a tile", 0, []uint8{8}, 183},
+		{"sprite 1 pixel into a tile", 0, []uint8{9}, 182},
+		{"sprite 4 pixels into a tile", 0, []uint8{12}, 179},
+		{"sprite 5 pixels into a tile", 0, []uint8{13}, 178},
+		{"sprite 7 pixels into a tile", 0, []uint8{15}, 178},
+		{"sprite with SCX", 3, []uint8{8}, 183},
+		{"two sprites in one tile", 0, []uint8{8, 8}, 189},
+		{"two sprites in different tiles", 0, []uint8{8, 16}, 194},
+		{"ten sprites", 0, []uint8{8, 8, 8, 8, 8, 8, 8, 8, 8, 8}, 237},
+		{"only ten sprites per line", 0, []uint8{8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8}, 237},
+		{"sprite at the right edge", 0, []uint8{167}, 178},
+		{"sprite off screen", 0, []uint8{168}, 172},
+	}
+
+	for _, test := range tests {
+		if got := mode3Length(test.scx, test.spriteXs); got != test.want {
+			t.Errorf("%s: mode 3 took %d dots, want %d", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package gbemu
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"sort"
+)
+
+// The heatmap counts every read and write the emulator makes to the 64 KiB
+// address space, plus per bank counts for the switchable ROM area. Every N
+// frames the counts are exported and reset:
+//	<prefix>_<frame>.png - 256x256 image, one pixel per address (x = low byte,
+//	                       y = high byte). Green is reads, red is writes, both
+//	                       on a log scale so rarely touched addresses still show.
+//	<prefix>_<frame>.csv - address,bank,reads,writes for every touched address
+
+type Heatmap interface {
+	RecordRead(uint16, int)
+	RecordWrite(uint16, int)
+	PresentFrame(*Framebuffer)
+}
+
+type heatmap struct {
+	reads          [0x10000]uint32
+	writes         [0x10000]uint32
+	bankReads      map[int]*[0x4000]uint32
+	bankWrites     map[int]*[0x4000]uint32
+	prefix         string
+	framesPerSlice int
+	frame          int
+}
+
+func CreateHeatmap(prefix string, framesPerSlice int) Heatmap {
+	if framesPerSlice < 1 {
+		framesPerSlice = 1
+	}
+	return &heatmap{
+		bankReads:      make(map[int]*[0x4000]uint32),
+		bankWrites:     make(map[int]*[0x4000]uint32),
+		prefix:         prefix,
+		framesPerSlice: framesPerSlice,
+	}
+}
+
+func (h *heatmap) RecordRead(address uint16, bank int) {
+	h.reads[address] += 1
+	if address >= 0x4000 && address <= 0x7FFF {
+		bankCounters(h.bankReads, bank)[address-0x4000] += 1
+	}
+}
+
+func (h *heatmap) RecordWrite(address uint16, bank int) {
+	h.writes[address] += 1
+	if address >= 0x4000 && address <= 0x7FFF {
+		bankCounters(h.bankWrites, bank)[address-0x4000] += 1
+	}
+}
+
+// Heatmaps are frame sinks so slices line up with emulated frames
+func (h *heatmap) PresentFrame(_ *Framebuffer) {
+	h.frame += 1
+	if h.frame%h.framesPerSlice != 0 {
+		return
+	}
+
+	filename := fmt.Sprintf("%s_%06d", h.prefix, h.frame)
+	if err := h.writePNG(filename + ".png"); err != nil {
+		fmt.Println(err)
+	}
+	if err := h.writeCSV(filename + ".csv"); err != nil {
+		fmt.Println(err)
+	}
+	h.reset()
+}
+
+func (h *heatmap) writePNG(filename string) error {
+	var maxCount uint32
+	for i := range h.reads {
+		if h.reads[i] > maxCount {
+			maxCount = h.reads[i]
+		}
+		if h.writes[i] > maxCount {
+			maxCount = h.writes[i]
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for address := 0; address < 0x10000; address++ {
+		img.SetRGBA(address&0xFF, address>>8, color.RGBA{
+			R: heatmapIntensity(h.writes[address], maxCount),
+			G: heatmapIntensity(h.reads[address], maxCount),
+			A: 0xFF,
+		})
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("ERROR creating heatmap image: %s", err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		return fmt.Errorf("ERROR writing heatmap image: %s", err)
+	}
+	return nil
+}
+
+func (h *heatmap) writeCSV(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("ERROR creating heatmap csv: %s", err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "address,bank,reads,writes")
+	for address := 0; address < 0x10000; address++ {
+		if address >= 0x4000 && address <= 0x7FFF {
+			continue // Written per bank below
+		}
+		if h.reads[address] != 0 || h.writes[address] != 0 {
+			fmt.Fprintf(w, "%04X,,%d,%d\n", address, h.reads[address], h.writes[address])
+		}
+	}
+
+	for _, bank := range h.banks() {
+		reads, writes := bankCounters(h.bankReads, bank), bankCounters(h.bankWrites, bank)
+		for i := range reads {
+			if reads[i] != 0 || writes[i] != 0 {
+				fmt.Fprintf(w, "%04X,%d,%d,%d\n", 0x4000+i, bank, reads[i], writes[i])
+			}
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("ERROR writing heatmap csv: %s", err)
+	}
+	return nil
+}
+
+func (h *heatmap) banks() []int {
+	seen := make(map[int]bool)
+	for bank := range h.bankReads {
+		seen[bank] = true
+	}
+	for bank := range h.bankWrites {
+		seen[bank] = true
+	}
+	banks := make([]int, 0, len(seen))
+	for bank := range seen {
+		banks = append(banks, bank)
+	}
+	sort.Ints(banks)
+	return banks
+}
+
+func (h *heatmap) reset() {
+	h.reads = [0x10000]uint32{}
+	h.writes = [0x10000]uint32{}
+	for _, counters := range h.bankReads {
+		*counters = [0x4000]uint32{}
+	}
+	for _, counters := range h.bankWrites {
+		*counters = [0x4000]uint32{}
+	}
+}
+
+func bankCounters(banks map[int]*[0x4000]uint32, bank int) *[0x4000]uint32 {
+	counters, found := banks[bank]
+	if !found {
+		counters = &[0x4000]uint32{}
+		banks[bank] = counters
+	}
+	return counters
+}
+
+func heatmapIntensity(count, maxCount uint32) uint8 {
+	if count == 0 || maxCount == 0 {
+		return 0
+	}
+	// Anything touched at all is at least faintly visible
+	scaled := math.Log1p(float64(count)) / math.Log1p(float64(maxCount))
+	return uint8(48 + scaled*207)
+}
@@ -0,0 +1,42 @@
+package gbemu
+
+import "testing"
+
+// Only accesses made by the program are counted, not the hardware updating
+// its own registers
+func TestHeatmapIgnoresHardwareRegisterUpdates(t *testing.T) {
+	h := CreateHeatmap("unused", 1000)
+	emulator, err := New(testROM("TEST"), Options{Heatmap: h})
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulator.WriteMemory(TIMER_CONTROL, 0x05)
+	for i := 0; i < 3; i++ {
+		emulator.RunFrame()
+	}
+
+	counts := h.(*heatmap)
+	for _, address := range []uint16{LCDC_Y_COORDINATE, DIVIDER_REGISTER, TIMER_REGISTER, TIMER_CONTROL, TIMER_MODULO} {
+		if reads, writes := counts.reads[address], counts.writes[address]; reads != 0 || writes != 0 {
+			t.Errorf("%04X counted %d reads and %d writes, want none", address, reads, writes)
+		}
+	}
+	if counts.writes[0xC000] == 0 {
+		t.Errorf("writes by the program to C000 weren't counted")
+	}
+}
+
+func TestDividerCounts(t *testing.T) {
+	m := CreateMMU()
+	timer := CreateTimer(m)
+	for i := 0; i < 256*10; i++ {
+		timer.Tick()
+	}
+	if got := m.ReadAt(DIVIDER_REGISTER); got != 10 {
+		t.Errorf("DIV after 2560 cycles = %d, want 10", got)
+	}
+	m.WriteByte(DIVIDER_REGISTER, 0x55)
+	if got := m.ReadAt(DIVIDER_REGISTER); got != 0 {
+		t.Errorf("DIV after a write = %d, want 0", got)
+	}
+}
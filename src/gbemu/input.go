@@ -0,0 +1,67 @@
+package gbemu
+
+// Buttons are the 8 physical inputs of the Gameboy. Frontends translate
+// whatever input device they have into these.
+type Button int
+
+const (
+	BUTTON_A Button = iota
+	BUTTON_B
+	BUTTON_SELECT
+	BUTTON_START
+	BUTTON_RIGHT
+	BUTTON_LEFT
+	BUTTON_UP
+	BUTTON_DOWN
+)
+
+type KeyPress struct {
+	Button  Button
+	Pressed bool
+}
+
+// InputSources are polled once per frame for any button changes since the
+// last poll
+type InputSource interface {
+	PollInput() []KeyPress
+}
+
+func (b Button) IsDirection() bool {
+	return b >= BUTTON_RIGHT
+}
+
+func (b Button) String() string {
+	switch b {
+	case BUTTON_A:
+		return "A"
+	case BUTTON_B:
+		return "B"
+	case BUTTON_SELECT:
+		return "Select"
+	case BUTTON_START:
+		return "Start"
+	case BUTTON_RIGHT:
+		return "Right"
+	case BUTTON_LEFT:
+		return "Left"
+	case BUTTON_UP:
+		return "Up"
+	case BUTTON_DOWN:
+		return "Down"
+	}
+	return "Unknown"
+}
+
+// ButtonState has one bit per Button, set while the button is held
+type ButtonState uint8
+
+func (s ButtonState) Pressed(b Button) bool {
+	return s&(1<<uint(b)) != 0
+}
+
+func (s ButtonState) With(b Button, pressed bool) ButtonState {
+	if pressed {
+		return s | 1<<uint(b)
+	}
+	return s &^ (1 << uint(b))
+}
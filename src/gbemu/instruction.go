@@ -1,4 +1,4 @@
-package main
+package gbemu
 
 import "fmt"
 
@@ -87,6 +87,7 @@ type pushInstruction struct {
 	source1 Register
 	source2 Register
 	regs    Registers
+	mmu     MMU
 }
 
 type popInstruction struct {
@@ -94,6 +95,7 @@ type popInstruction struct {
 	source1 Register
 	source2 Register
 	regs    Registers
+	mmu     MMU
 }
 
 type addInstruction struct {
@@ -241,11 +243,13 @@ type inc16BitInstruction struct {
 	source1 Register
 	source2 Register
 	regs    Registers
+	mmu     MMU
 }
 
 type incSP16BitInstruction struct {
 	basicInstruction
 	regs Registers
+	mmu  MMU
 }
 
 type dec16BitInstruction struct {
@@ -253,11 +257,13 @@ type dec16BitInstruction struct {
 	source1 Register
 	source2 Register
 	regs    Registers
+	mmu     MMU
 }
 
 type decSP16BitInstruction struct {
 	basicInstruction
 	regs Registers
+	mmu  MMU
 }
 
 type daaInstruction struct {
@@ -635,18 +641,18 @@ func CreateInstructions(regs Registers, mmu MMU, cpu CPU) map[byte]Instruction {
 		0x21: &loadTwoByteImmediateInstruction{basicInstruction{12, 2}, h, l, regs},
 		0x31: &loadSpTwoByteImmediateInstruction{basicInstruction{12, 2}, regs},
 
-		0xF5: &pushInstruction{basicInstruction{16, 0}, a, f, regs},
+		0xF5: &pushInstruction{basicInstruction{16, 0}, a, f, regs, mmu},
 		0xF8: &ldhlspInstruction{basicInstruction{12, 1}, h, l, regs},
 		0xF9: &ldsphlInstruction{basicInstruction{8, 0}, h, l, regs},
-		0xC5: &pushInstruction{basicInstruction{16, 0}, b, c, regs},
-		0xD5: &pushInstruction{basicInstruction{16, 0}, d, e, regs},
+		0xC5: &pushInstruction{basicInstruction{16, 0}, b, c, regs, mmu},
+		0xD5: &pushInstruction{basicInstruction{16, 0}, d, e, regs, mmu},
 		0xE0: &ldhImmediateInstruction{basicInstruction{12, 1}, a, regs, mmu},
-		0xE5: &pushInstruction{basicInstruction{16, 0}, h, l, regs},
+		0xE5: &pushInstruction{basicInstruction{16, 0}, h, l, regs, mmu},
 		0xF0: &ldhaInstruction{basicInstruction{12, 1}, a, regs, mmu},
-		0xF1: &popInstruction{basicInstruction{12, 0}, a, f, regs},
-		0xC1: &popInstruction{basicInstruction{12, 0}, b, c, regs},
-		0xD1: &popInstruction{basicInstruction{12, 0}, d, e, regs},
-		0xE1: &popInstruction{basicInstruction{12, 0}, h, l, regs},
+		0xF1: &popInstruction{basicInstruction{12, 0}, a, f, regs, mmu},
+		0xC1: &popInstruction{basicInstruction{12, 0}, b, c, regs, mmu},
+		0xD1: &popInstruction{basicInstruction{12, 0}, d, e, regs, mmu},
+		0xE1: &popInstruction{basicInstruction{12, 0}, h, l, regs, mmu},
 		0x87: &addInstruction{basicInstruction{4, 0}, a, regs},
 		0x80: &addInstruction{basicInstruction{4, 0}, b, regs},
 		0x81: &addInstruction{basicInstruction{4, 0}, c, regs},
@@ -739,14 +745,14 @@ func CreateInstructions(regs Registers, mmu MMU, cpu CPU) map[byte]Instruction {
 		0x29: &add16BitInstruction{basicInstruction{8, 0}, h, l, regs},
 		0x39: &add16BitFromSPInstruction{basicInstruction{8, 0}, regs},
 		0xE8: &addSP16BitInstruction{basicInstruction{16, 0}, regs},
-		0x03: &inc16BitInstruction{basicInstruction{8, 0}, b, c, regs},
-		0x13: &inc16BitInstruction{basicInstruction{8, 0}, d, e, regs},
-		0x23: &inc16BitInstruction{basicInstruction{8, 0}, h, l, regs},
-		0x33: &incSP16BitInstruction{basicInstruction{8, 0}, regs},
-		0x0B: &dec16BitInstruction{basicInstruction{8, 0}, b, c, regs},
-		0x1B: &dec16BitInstruction{basicInstruction{8, 0}, d, e, regs},
-		0x2B: &dec16BitInstruction{basicInstruction{8, 0}, h, l, regs},
-		0x3B: &decSP16BitInstruction{basicInstruction{8, 0}, regs},
+		0x03: &inc16BitInstruction{basicInstruction{8, 0}, b, c, regs, mmu},
+		0x13: &inc16BitInstruction{basicInstruction{8, 0}, d, e, regs, mmu},
+		0x23: &inc16BitInstruction{basicInstruction{8, 0}, h, l, regs, mmu},
+		0x33: &incSP16BitInstruction{basicInstruction{8, 0}, regs, mmu},
+		0x0B: &dec16BitInstruction{basicInstruction{8, 0}, b, c, regs, mmu},
+		0x1B: &dec16BitInstruction{basicInstruction{8, 0}, d, e, regs, mmu},
+		0x2B: &dec16BitInstruction{basicInstruction{8, 0}, h, l, regs, mmu},
+		0x3B: &decSP16BitInstruction{basicInstruction{8, 0}, regs, mmu},
 		0x27: &daaInstruction{basicInstruction{4, 0}, regs},
 		0x2F: &cplInstruction{basicInstruction{4, 0}, regs},
 		0x3F: &ccfInstruction{basicInstruction{4, 0}, regs},
@@ -880,6 +886,7 @@ func (i *ldiInstruction) Execute(params Parameters) Addresser {
 	if err != nil {
 		fmt.Println(err)
 	}
+	i.mmu.CorruptOAM(addr, OAM_BUG_READ_INC_DEC, 1)
 	val := i.mmu.ReadAt(addr)
 	i.regs.WriteRegister(i.dest, val)
 	i.regs.WriteRegisterPair(i.source1, i.source2, addr+1)
@@ -892,6 +899,7 @@ func (i *ldihlInstruction) Execute(params Parameters) Addresser {
 	if err != nil {
 		fmt.Println(err)
 	}
+	i.mmu.CorruptOAM(addr, OAM_BUG_WRITE, 1)
 	i.mmu.WriteByte(addr, val)
 	i.regs.WriteRegisterPair(i.dest1, i.dest2, addr+1)
 	return &address{}
@@ -903,6 +911,7 @@ func (i *lddhlInstruction) Execute(params Parameters) Addresser {
 	if err != nil {
 		fmt.Println(err)
 	}
+	i.mmu.CorruptOAM(addr, OAM_BUG_WRITE, 1)
 	i.mmu.WriteByte(addr, val)
 	i.regs.WriteRegisterPair(i.dest1, i.dest2, addr-1)
 	return &address{}
@@ -913,6 +922,7 @@ func (i *lddInstruction) Execute(params Parameters) Addresser {
 	if err != nil {
 		fmt.Println(err)
 	}
+	i.mmu.CorruptOAM(addr, OAM_BUG_READ_INC_DEC, 1)
 	val := i.mmu.ReadAt(addr)
 	i.regs.WriteRegister(i.dest, val)
 	i.regs.WriteRegisterPair(i.source1, i.source2, addr-1)
@@ -940,6 +950,11 @@ func (i *pushInstruction) Execute(params Parameters) Addresser {
 	if err != nil {
 		fmt.Println(err)
 	}
+	// SP is decremented once on its own, then once with each write
+	sp := i.regs.ReadSP()
+	i.mmu.CorruptOAM(sp, OAM_BUG_WRITE, 1)
+	i.mmu.CorruptOAM(sp-1, OAM_BUG_WRITE, 2)
+	i.mmu.CorruptOAM(sp-2, OAM_BUG_WRITE, 3)
 	i.regs.PushSP(val)
 	return &address{}
 }
@@ -962,6 +977,9 @@ func (i *writeMemoryInstruction) Execute(params Parameters) Addresser {
 }
 
 func (i *popInstruction) Execute(params Parameters) Addresser {
+	sp := i.regs.ReadSP()
+	i.mmu.CorruptOAM(sp, OAM_BUG_READ_INC_DEC, 1)
+	i.mmu.CorruptOAM(sp+1, OAM_BUG_READ_INC_DEC, 2)
 	stackValue := i.regs.PopSP()
 	i.regs.WriteRegister(i.source1, byte((stackValue&0xFF00)>>8))
 	i.regs.WriteRegister(i.source2, byte(stackValue&0x00FF))
@@ -1585,12 +1603,14 @@ func (i *inc16BitInstruction) Execute(params Parameters) Addresser {
 		fmt.Println(err)
 	}
 
+	i.mmu.CorruptOAM(val, OAM_BUG_WRITE, 1)
 	val += 1
 	i.regs.WriteRegisterPair(i.source1, i.source2, val)
 	return &address{}
 }
 
 func (i *incSP16BitInstruction) Execute(params Parameters) Addresser {
+	i.mmu.CorruptOAM(i.regs.ReadSP(), OAM_BUG_WRITE, 1)
 	i.regs.WriteSP(i.regs.PopSP() + 1)
 	return &address{}
 }
@@ -1635,6 +1655,7 @@ func (i *add16BitInstruction) Execute(params Parameters) Addresser {
 }
 
 func (i *decSP16BitInstruction) Execute(params Parameters) Addresser {
+	i.mmu.CorruptOAM(i.regs.ReadSP(), OAM_BUG_WRITE, 1)
 	i.regs.WriteSP(i.regs.PopSP() - 1)
 	return &address{}
 }
@@ -1644,6 +1665,7 @@ func (i *dec16BitInstruction) Execute(params Parameters) Addresser {
 	if err != nil {
 		fmt.Println(err)
 	}
+	i.mmu.CorruptOAM(val, OAM_BUG_WRITE, 1)
 	val -= 1
 	i.regs.WriteRegisterPair(i.source1, i.source2, uint16(val))
 	return &address{}
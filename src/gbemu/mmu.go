@@ -1,8 +1,7 @@
-package main
+package gbemu
 
 import (
 	"fmt"
-	"github.com/go-gl/glfw/v3.3/glfw"
 	"runtime/debug"
 )
 
@@ -111,15 +110,26 @@ type MMU interface {
 	Reset()
 	InitRom([]byte)
 	ReadAt(uint16) uint8
+	ReadVideoMemory(uint16) uint8
+	PeekAt(uint16) uint8
+	PokeAt(uint16, uint8)
+	ReadIORegister(uint16) uint8
+	WriteIORegister(uint16, uint8)
+	FetchInstructionByte(uint16, bool) uint8
 	WriteByte(uint16, uint8)
+	ROMBank() int
 	LCDStatusMode() uint8
 	SetLCDStatusMode(uint8)
+	SetLYCoincidence(bool)
+	STATWritten() bool
 	SpriteSize() int
 	LCDEnabled() bool
 	WindowTileMap() uint16
 	WindowDisplayEnabled() bool
 	WindowXPosition() uint8
 	WindowYPosition() uint8
+	ScrollX() uint8
+	ScrollY() uint8
 	BGAndWindowAddressMode() AddressMode
 	BGTileMap() uint16
 	SpritesEnabled() bool
@@ -132,51 +142,81 @@ type MMU interface {
 	FireInterrupt(Interrupt)
 	ReadJoypadInput(uint8) uint8
 	Tick()
-	AddKeyPressEvent(KeyPress)
+	SetButtons(ButtonState)
+	SetCodeDataLogger(CodeDataLogger)
+	SetHeatmap(Heatmap)
+	SetAccessBlocking(bool)
+	SetLineDot(int)
+	CorruptOAM(uint16, OAMBugAccess, int)
+	Snapshotter
 }
 
 type mmu struct {
-	ROM                [32768]uint8 // 0x0000 - 0x7FFF
-	VRAM               [8192]uint8  // 0x8000 - 0x9FFF
-	SwitchableRAM      [8192]uint8  // 0xA000 - 0xBFFF
-	InternalRAM        [8192]uint8  // 0xC000 - 0xDFFF
-	EchoRAM            [8192]uint8  // 0xE000 - 0xFDFF
-	OAM                [160]uint8   // 0xFE00 - 0xFE9F
-	Unused             [95]uint8    // 0xFEA0 - 0xFEFF
-	IoPorts            [128]uint8   // 0xFF00 - 0xFF7F
-	HRAM               [127]uint8   // 0xFF80 - 0xFFFE
-	InterruptEnable    uint8        // 0xFFFF
-	colorMapping       map[int]RGBPixel
-	interruptMapping   map[int]uint16
-	directionKeyEvents chan KeyPress
-	buttonKeyEvents    chan KeyPress
-	lastKeyPress       uint8
+	ROM              [32768]uint8 // 0x0000 - 0x7FFF
+	VRAM             [8192]uint8  // 0x8000 - 0x9FFF
+	SwitchableRAM    [8192]uint8  // 0xA000 - 0xBFFF
+	InternalRAM      [8192]uint8  // 0xC000 - 0xDFFF
+	EchoRAM          [8192]uint8  // 0xE000 - 0xFDFF
+	OAM              [160]uint8   // 0xFE00 - 0xFE9F
+	Unused           [95]uint8    // 0xFEA0 - 0xFEFF
+	IoPorts          [128]uint8   // 0xFF00 - 0xFF7F
+	HRAM             [127]uint8   // 0xFF80 - 0xFFFE
+	InterruptEnable  uint8        // 0xFFFF
+	colorMapping     map[int]RGBPixel
+	interruptMapping map[int]uint16
+	buttons          ButtonState
+	codeDataLogger   CodeDataLogger
+	lastROMRead      int   // ROM offset of the last data read, used to trace tile data copied into VRAM
+	lastROMValue     uint8 // Value of the last data read from ROM
+	vramSources      []int // ROM offset + 1 that each byte of VRAM tile data was copied from, 0 if unknown
+	heatmap          Heatmap
+	statWritten      bool
+	accessBlocking   bool // Lock the CPU out of VRAM/OAM while the PPU is using them
+	dma              oamDMA
+	lineDot          int // Dot the display is at in the current line, for the OAM bug
+	instructionDot   int // Dot the current instruction's opcode was fetched at
+}
+
+// How the CPU uses an address that triggers the OAM bug
+type OAMBugAccess int
+
+const (
+	OAM_BUG_WRITE OAMBugAccess = iota
+	OAM_BUG_READ
+	OAM_BUG_READ_INC_DEC // A read while the same register is incremented or decremented
+)
+
+// The PPU reads OAM in rows of 8 bytes during the OAM search
+const OAM_ROWS int = 20
+
+// OAM DMA copies 160 bytes into OAM, one per M-cycle, starting one M-cycle
+// after the write to 0xFF46. While it runs the CPU can only use HRAM and the
+// IO registers.
+type oamDMA struct {
+	active     bool
+	source     uint16
+	index      int
+	ticks      int
+	value      uint8  // Last byte copied, which is what the CPU sees on the same bus
+	startDelay int    // Ticks until a newly written transfer takes over
+	nextSource uint16 // Source of the transfer that's about to start
 }
 
 func CreateMMU() MMU {
 	return &mmu{
-		colorMapping:       createColorMapping(),
-		interruptMapping:   createBitToInterruptMap(),
-		directionKeyEvents: make(chan KeyPress, 500),
-		buttonKeyEvents:    make(chan KeyPress, 500),
-		lastKeyPress:       0xEF,
+		colorMapping:     createColorMapping(),
+		interruptMapping: createBitToInterruptMap(),
+		lastROMRead:      -1,
+		accessBlocking:   true,
 	}
 }
 
-func (m *mmu) AddKeyPressEvent(keyPress KeyPress) {
-	if keyPress.Key == glfw.KeyUp || keyPress.Key == glfw.KeyDown || keyPress.Key == glfw.KeyLeft || keyPress.Key == glfw.KeyRight {
-		select {
-		case m.directionKeyEvents <- keyPress:
-		default:
-		}
-		m.FireInterrupt(JOYPAD_INTERRUPT)
-	} else if keyPress.Key == glfw.KeyRightControl || keyPress.Key == glfw.KeyRightShift || keyPress.Key == glfw.KeyBackspace || keyPress.Key == glfw.KeyEnter {
-		select {
-		case m.buttonKeyEvents <- keyPress:
-		default:
-		}
-		m.FireInterrupt(JOYPAD_INTERRUPT)
-	}
+// SetButtons is only called between instructions so that the joypad register
+// always changes at the same point of a run
+func (m *mmu) SetButtons(buttons ButtonState) {
+	previous := m.joypadLines(m.IoPorts[0])
+	m.buttons = buttons
+	m.checkJoypadInterrupt(previous)
 }
 
 func createColorMapping() map[int]RGBPixel {
@@ -217,17 +257,108 @@ func (m *mmu) Reset() {
 	m.WriteByte(OBJECT_PALLETTE_1, 0xFF)
 }
 
+func (m *mmu) SetCodeDataLogger(logger CodeDataLogger) {
+	m.codeDataLogger = logger
+	m.vramSources = make([]int, 0x1800)
+}
+
+func (m *mmu) SetHeatmap(heatmap Heatmap) {
+	m.heatmap = heatmap
+}
+
+// SetAccessBlocking turns the CPU lockout of VRAM and OAM on or off, for
+// games that only work with the lockout missing
+func (m *mmu) SetAccessBlocking(blocking bool) {
+	m.accessBlocking = blocking
+}
+
+// ReadAt reads from the CPU bus, where VRAM and OAM read 0xFF while the PPU
+// is using them and everything outside HRAM is blocked during OAM DMA
 func (m *mmu) ReadAt(address uint16) uint8 {
+	if value, blocked := m.busConflict(address); blocked {
+		if m.heatmap != nil {
+			m.heatmap.RecordRead(address, m.ROMBank())
+		}
+		return value
+	}
+	return m.readLogged(address)
+}
+
+// ReadVideoMemory is used by the PPU, which can always access VRAM and OAM
+// except for OAM during DMA
+func (m *mmu) ReadVideoMemory(address uint16) uint8 {
+	if m.dma.active && address >= 0xFE00 && address <= 0xFE9F {
+		return 0xFF
+	}
+	if m.codeDataLogger != nil && address >= 0x8000 && address <= 0x97FF {
+		if source := m.vramSources[address-0x8000]; source != 0 {
+			m.codeDataLogger.Log(source-1, CDL_TILE)
+		}
+	}
+	return m.readLogged(address)
+}
+
+func (m *mmu) readLogged(address uint16) uint8 {
+	value := m.read(address)
+	if m.codeDataLogger != nil {
+		m.logDataRead(address, value)
+	}
+	if m.heatmap != nil {
+		m.heatmap.RecordRead(address, m.ROMBank())
+	}
+	return value
+}
+
+// FetchInstructionByte is used by the CPU to read opcodes and their operands
+// so they aren't logged as data reads
+func (m *mmu) FetchInstructionByte(address uint16, operand bool) uint8 {
+	if !operand {
+		m.instructionDot = m.lineDot
+	}
+	if m.heatmap != nil {
+		m.heatmap.RecordRead(address, m.ROMBank())
+	}
+	if value, blocked := m.busConflict(address); blocked {
+		return value
+	}
+	if m.codeDataLogger != nil && address <= 0x7FFF {
+		if operand {
+			m.codeDataLogger.Log(ROMOffset(address, m.ROMBank()), CDL_OPERAND)
+		} else {
+			m.codeDataLogger.Log(ROMOffset(address, m.ROMBank()), CDL_CODE)
+		}
+	}
+	return m.read(address)
+}
+
+func (m *mmu) logDataRead(address uint16, value uint8) {
+	if address <= 0x7FFF {
+		m.lastROMRead = ROMOffset(address, m.ROMBank())
+		m.lastROMValue = value
+		m.codeDataLogger.Log(m.lastROMRead, CDL_DATA)
+	}
+}
+
+// When the value written into the tile data area of VRAM is the one that was
+// just read from ROM, assume it's part of a copy loop so that the ROM bytes
+// can be marked as tile data once the PPU fetches them
+func (m *mmu) trackVRAMSource(address uint16, value uint8) {
+	if address > 0x97FF {
+		return
+	}
+	if m.lastROMRead >= 0 && value == m.lastROMValue {
+		m.vramSources[address-0x8000] = m.lastROMRead + 1
+	} else {
+		m.vramSources[address-0x8000] = 0
+	}
+	m.lastROMRead = -1
+}
+
+func (m *mmu) read(address uint16) uint8 {
 	switch {
 	case address >= 0x0000 && address <= 0x7FFF:
 		return m.ROM[address]
 	case address >= 0x8000 && address <= 0x9FFF:
-		/*
-			if !m.CanAccessVRAM() {
-				fmt.Println("Accessing VRAM at an illegal time...")
-				return 0xFF
-			}
-		*/
 		return m.VRAM[address-0x8000]
 	case address >= 0xA000 && address <= 0xBFFF:
 		return m.SwitchableRAM[address-0xA000]
@@ -236,12 +367,6 @@ func (m *mmu) ReadAt(address uint16) uint8 {
 	case address >= 0xE000 && address <= 0xFDFF:
 		return m.EchoRAM[address-0xE000]
 	case address >= 0xFE00 && address <= 0xFE9F:
-		/*
-			if !m.CanAccessOAM() {
-				fmt.Println("Accessing OAM at an illegal time...")
-				return 0xFF
-			}
-		*/
 		return m.OAM[address-0xFE00]
 	case address >= 0xFF00 && address <= 0xFF7F:
 		switch address {
@@ -262,17 +387,38 @@ func (m *mmu) ReadAt(address uint16) uint8 {
 	return 0
 }
 
+// PeekAt reads memory without any side effects so debugging tools can inspect
+// the address space without disturbing the running game
+func (m *mmu) PeekAt(address uint16) uint8 {
+	return m.read(address)
+}
+
+// PokeAt writes memory whatever the PPU or DMA are doing, for the host and
+// debugging tools
+func (m *mmu) PokeAt(address uint16, value uint8) {
+	m.write(address, value)
+}
+
+// WriteByte writes on the CPU bus, where writes to VRAM and OAM are dropped
+// while the CPU is locked out of them
 func (m *mmu) WriteByte(address uint16, value uint8) {
+	if m.heatmap != nil {
+		m.heatmap.RecordWrite(address, m.ROMBank())
+	}
+	if _, blocked := m.busConflict(address); blocked {
+		return
+	}
+	m.write(address, value)
+}
+
+func (m *mmu) write(address uint16, value uint8) {
 	switch {
 	case address >= 0x0000 && address <= 0x7FFF:
-		fmt.Println(address)
-		//m.ROM[address] = value
+		// No MBC, so writes to ROM are ignored
 	case address >= 0x8000 && address <= 0x9FFF:
-		/*
-			if !m.CanAccessVRAM() {
-				fmt.Println("Accessing VRAM at an illegal time...")
-			}
-		*/
+		if m.codeDataLogger != nil {
+			m.trackVRAMSource(address, value)
+		}
 		m.VRAM[address-0x8000] = value
 	case address >= 0xA000 && address <= 0xBFFF:
 		m.SwitchableRAM[address-0xA000] = value
@@ -283,12 +429,6 @@ func (m *mmu) WriteByte(address uint16, value uint8) {
 	case address >= 0xE000 && address <= 0xFDFF:
 		m.EchoRAM[address-0xE000] = value
 	case address >= 0xFE00 && address <= 0xFE9F:
-		/*
-			if !m.CanAccessOAM() {
-				fmt.Println("Accessing OAM at an illegal time...")
-				return
-			}
-		*/
 		m.OAM[address-0xFE00] = value
 	case address >= 0xFEA0 && address <= 0xFEFF:
 		return
@@ -299,9 +439,13 @@ func (m *mmu) WriteByte(address uint16, value uint8) {
 		case DMA_TRANSFER_ADDRESS:
 			m.startDMA(value)
 		case LCDC_STATUS:
-			value = (value & 0x78) | (m.ReadAt(LCDC_STATUS) & 0x87) // Bits 7, 2, 1, 0 are read-only
+			value = (value & 0x78) | (m.ReadIORegister(LCDC_STATUS) & 0x87) // Bits 7, 2, 1, 0 are read-only
+			m.statWritten = true
 		case JOYPAD_INPUT:
 			value &= 0x30 // Only bits 4 and 5 can be set
+			previous := m.joypadLines(m.IoPorts[0])
+			m.IoPorts[0] = value
+			m.checkJoypadInterrupt(previous) // Selecting a line with a button held pulls it low
 		default:
 		}
 		m.IoPorts[address-0xFF00] = value
@@ -316,33 +460,93 @@ func (m *mmu) WriteByte(address uint16, value uint8) {
 	}
 }
 
+// Cartridges without a memory bank controller always have bank 1 mapped
+// into 0x4000 - 0x7FFF
+func (m *mmu) ROMBank() int {
+	return 1
+}
+
+// ReadIORegister is used by the hardware to read its registers without going
+// over the CPU bus
+func (m *mmu) ReadIORegister(address uint16) uint8 {
+	return m.IoPorts[address-0xFF00]
+}
+
+// WriteIORegister is used by the hardware to update its registers. Unlike a
+// CPU write it has no side effects and isn't counted by the heatmap.
+func (m *mmu) WriteIORegister(address uint16, value uint8) {
+	m.IoPorts[address-0xFF00] = value
+}
+
 func (m *mmu) LCDStatusMode() uint8 {
-	return m.ReadAt(LCDC_STATUS) & 0x03
+	return m.ReadIORegister(LCDC_STATUS) & 0x03
 }
 
 // This is the only method allowed to set the bottom 2 bits of the
 // LCDC Status register directly
 func (m *mmu) SetLCDStatusMode(mode uint8) {
-	value := m.ReadAt(LCDC_STATUS)&0xFC + mode
+	value := m.ReadIORegister(LCDC_STATUS)&0xFC + mode
 	m.IoPorts[LCDC_STATUS-0xFF00] = value
 }
 
-func (m *mmu) CanAccessOAM() bool {
-	mode := m.LCDStatusMode()
-	return (mode == 0 || mode == 1)
+func (m *mmu) SetLYCoincidence(coincidence bool) {
+	if coincidence {
+		m.IoPorts[LCDC_STATUS-0xFF00] |= 0x04
+	} else {
+		m.IoPorts[LCDC_STATUS-0xFF00] &^= 0x04
+	}
+}
+
+// STATWritten reports whether the CPU wrote to STAT since the last call, for
+// the DMG STAT write bug
+func (m *mmu) STATWritten() bool {
+	written := m.statWritten
+	m.statWritten = false
+	return written
+}
+
+// busConflict returns what the CPU reads from an address it can't access right
+// now. During DMA a read on the bus DMA is using returns the byte being copied.
+func (m *mmu) busConflict(address uint16) (uint8, bool) {
+	if m.dma.active && address < 0xFF00 {
+		if address < 0xFE00 && isVRAMAddress(address) == isVRAMAddress(m.dma.source) {
+			return m.dma.value, true
+		}
+		return 0xFF, true
+	}
+	if m.accessBlocked(address) {
+		return 0xFF, true
+	}
+	return 0, false
+}
+
+// VRAM has its own bus, everything else below OAM is on the external bus
+func isVRAMAddress(address uint16) bool {
+	return address >= 0x8000 && address <= 0x9FFF
 }
 
-func (m *mmu) CanAccessVRAM() bool {
-	mode := m.LCDStatusMode()
-	return mode != 3
+// The CPU can't access OAM during the OAM search and pixel transfer, or VRAM
+// during pixel transfer
+func (m *mmu) accessBlocked(address uint16) bool {
+	if !m.accessBlocking || address < 0x8000 || address > 0xFE9F {
+		return false
+	}
+	mode := m.IoPorts[LCDC_STATUS-0xFF00] & 0x03
+	switch {
+	case address <= 0x9FFF:
+		return mode == PIXEL_TRANSFER_MODE
+	case address >= 0xFE00:
+		return mode == OAM_SEARCH_MODE || mode == PIXEL_TRANSFER_MODE
+	}
+	return false
 }
 
 func (m *mmu) LCDEnabled() bool {
-	return GetBit(m.ReadAt(0xFF40), 7) == 1
+	return GetBit(m.ReadIORegister(0xFF40), 7) == 1
 }
 
 func (m *mmu) WindowTileMap() uint16 {
-	if GetBit(m.ReadAt(0xFF40), 6) == 1 {
+	if GetBit(m.ReadIORegister(0xFF40), 6) == 1 {
 		return uint16(0x9C00)
 	} else {
 		return uint16(0x9800)
@@ -350,19 +554,27 @@ func (m *mmu) WindowTileMap() uint16 {
 }
 
 func (m *mmu) WindowDisplayEnabled() bool {
-	return GetBit(m.ReadAt(0xFF40), 5) == 1
+	return GetBit(m.ReadIORegister(0xFF40), 5) == 1
 }
 
 func (m *mmu) WindowXPosition() uint8 {
-	return m.ReadAt(WINDOW_X_POSITION)
+	return m.ReadIORegister(WINDOW_X_POSITION)
 }
 
 func (m *mmu) WindowYPosition() uint8 {
-	return m.ReadAt(WINDOW_Y_POSITION)
+	return m.ReadIORegister(WINDOW_Y_POSITION)
+}
+
+func (m *mmu) ScrollX() uint8 {
+	return m.ReadIORegister(SCROLL_X)
+}
+
+func (m *mmu) ScrollY() uint8 {
+	return m.ReadIORegister(SCROLL_Y)
 }
 
 func (m *mmu) BGAndWindowAddressMode() AddressMode {
-	if GetBit(m.ReadAt(0xFF40), 4) == 1 {
+	if GetBit(m.ReadIORegister(0xFF40), 4) == 1 {
 		return ADDRESS_MODE_8000
 	} else {
 		return ADDRESS_MODE_8800
@@ -370,7 +582,7 @@ func (m *mmu) BGAndWindowAddressMode() AddressMode {
 }
 
 func (m *mmu) BGTileMap() uint16 {
-	if GetBit(m.ReadAt(0xFF40), 3) == 1 {
+	if GetBit(m.ReadIORegister(0xFF40), 3) == 1 {
 		return uint16(0x9C00)
 	} else {
 		return uint16(0x9800)
@@ -378,65 +590,66 @@ func (m *mmu) BGTileMap() uint16 {
 }
 
 func (m *mmu) SpriteSize() int {
-	return GetBit(m.ReadAt(0xFF40), 2)
+	return GetBit(m.ReadIORegister(0xFF40), 2)
 }
 
 func (m *mmu) SpritesEnabled() bool {
-	return GetBit(m.ReadAt(0xFF40), 1) == 1
+	return GetBit(m.ReadIORegister(0xFF40), 1) == 1
 }
 
 func (m *mmu) BGDisplayEnabled() bool {
-	return GetBit(m.ReadAt(0xFF40), 0) == 1
+	return GetBit(m.ReadIORegister(0xFF40), 0) == 1
 }
 
 func (m *mmu) Tick() {
+	m.tickDMA()
 }
 
 func (m *mmu) bgShadeForColor0() RGBPixel {
-	highBit := GetBit(m.ReadAt(0xFF47), 1)
-	lowBit := GetBit(m.ReadAt(0xFF47), 0)
+	highBit := GetBit(m.ReadIORegister(0xFF47), 1)
+	lowBit := GetBit(m.ReadIORegister(0xFF47), 0)
 	return m.colorMapping[BitsToNum(highBit, lowBit)]
 }
 
 func (m *mmu) bgShadeForColor1() RGBPixel {
-	highBit := GetBit(m.ReadAt(0xFF47), 3)
-	lowBit := GetBit(m.ReadAt(0xFF47), 2)
+	highBit := GetBit(m.ReadIORegister(0xFF47), 3)
+	lowBit := GetBit(m.ReadIORegister(0xFF47), 2)
 	return m.colorMapping[BitsToNum(highBit, lowBit)]
 }
 
 func (m *mmu) bgShadeForColor2() RGBPixel {
-	highBit := GetBit(m.ReadAt(0xFF47), 5)
-	lowBit := GetBit(m.ReadAt(0xFF47), 4)
+	highBit := GetBit(m.ReadIORegister(0xFF47), 5)
+	lowBit := GetBit(m.ReadIORegister(0xFF47), 4)
 	return m.colorMapping[BitsToNum(highBit, lowBit)]
 }
 
 func (m *mmu) bgShadeForColor3() RGBPixel {
-	highBit := GetBit(m.ReadAt(0xFF47), 7)
-	lowBit := GetBit(m.ReadAt(0xFF47), 6)
+	highBit := GetBit(m.ReadIORegister(0xFF47), 7)
+	lowBit := GetBit(m.ReadIORegister(0xFF47), 6)
 	return m.colorMapping[BitsToNum(highBit, lowBit)]
 }
 
 func (m *mmu) spriteShadeForColor0(paletteNum int) RGBPixel {
-	highBit := GetBit(m.ReadAt(0xFF48+uint16(paletteNum)), 1)
-	lowBit := GetBit(m.ReadAt(0xFF48+uint16(paletteNum)), 0)
+	highBit := GetBit(m.ReadIORegister(0xFF48+uint16(paletteNum)), 1)
+	lowBit := GetBit(m.ReadIORegister(0xFF48+uint16(paletteNum)), 0)
 	return m.colorMapping[BitsToNum(highBit, lowBit)]
 }
 
 func (m *mmu) spriteShadeForColor1(paletteNum int) RGBPixel {
-	highBit := GetBit(m.ReadAt(0xFF48+uint16(paletteNum)), 3)
-	lowBit := GetBit(m.ReadAt(0xFF48+uint16(paletteNum)), 2)
+	highBit := GetBit(m.ReadIORegister(0xFF48+uint16(paletteNum)), 3)
+	lowBit := GetBit(m.ReadIORegister(0xFF48+uint16(paletteNum)), 2)
 	return m.colorMapping[BitsToNum(highBit, lowBit)]
 }
 
 func (m *mmu) spriteShadeForColor2(paletteNum int) RGBPixel {
-	highBit := GetBit(m.ReadAt(0xFF48+uint16(paletteNum)), 5)
-	lowBit := GetBit(m.ReadAt(0xFF48+uint16(paletteNum)), 4)
+	highBit := GetBit(m.ReadIORegister(0xFF48+uint16(paletteNum)), 5)
+	lowBit := GetBit(m.ReadIORegister(0xFF48+uint16(paletteNum)), 4)
 	return m.colorMapping[BitsToNum(highBit, lowBit)]
 }
 
 func (m *mmu) spriteShadeForColor3(paletteNum int) RGBPixel {
-	highBit := GetBit(m.ReadAt(0xFF48+uint16(paletteNum)), 7)
-	lowBit := GetBit(m.ReadAt(0xFF48+uint16(paletteNum)), 6)
+	highBit := GetBit(m.ReadIORegister(0xFF48+uint16(paletteNum)), 7)
+	lowBit := GetBit(m.ReadIORegister(0xFF48+uint16(paletteNum)), 6)
 	return m.colorMapping[BitsToNum(highBit, lowBit)]
 }
 
@@ -466,93 +679,216 @@ func (m *mmu) ConvertNumToSpritePixel(i, paletteNum int) RGBPixel {
 	}
 }
 
+// The interrupt registers are used by the CPU and the hardware internally,
+// not over the bus
 func (m *mmu) HasPendingInterrupt() bool {
-	return m.ReadAt(INTERRUPT_ENABLE)&m.ReadAt(INTERRUPT_FLAGS) != 0
+	return m.InterruptEnable&m.IoPorts[INTERRUPT_FLAGS-0xFF00] != 0
 }
 
 func (m *mmu) GetNextPendingInterrupt() uint16 {
-	return m.interruptMapping[GetHighestInterruptBit(m.ReadAt(INTERRUPT_ENABLE)&m.ReadAt(INTERRUPT_FLAGS))]
+	return m.interruptMapping[GetHighestInterruptBit(m.InterruptEnable&m.IoPorts[INTERRUPT_FLAGS-0xFF00])]
 }
 
 func (m *mmu) ClearHighestInterrupt() {
-	interruptFlags := m.ReadAt(INTERRUPT_FLAGS)
-	bit := GetHighestInterruptBit(m.ReadAt(INTERRUPT_ENABLE) & interruptFlags)
+	interruptFlags := m.IoPorts[INTERRUPT_FLAGS-0xFF00]
+	bit := GetHighestInterruptBit(m.InterruptEnable & interruptFlags)
 	temp := (1 << uint(bit))
-	m.WriteByte(INTERRUPT_FLAGS, interruptFlags&uint8(temp^31))
+	m.IoPorts[INTERRUPT_FLAGS-0xFF00] = interruptFlags & uint8(temp^31)
 }
 
 func (m *mmu) FireInterrupt(interrupt Interrupt) {
-	val := m.ReadAt(INTERRUPT_FLAGS) | (1 << uint(interrupt))
-	m.WriteByte(INTERRUPT_FLAGS, val)
+	m.IoPorts[INTERRUPT_FLAGS-0xFF00] |= 1 << uint(interrupt)
 }
 
+// A transfer that is already running carries on until the new one starts, so
+// OAM stays blocked when DMA is restarted
 func (m *mmu) startDMA(value uint8) {
-	addr := uint16(value) << 8
-	for i := 0; i < 0xA0; i++ {
-		m.WriteByte(0xFE00+uint16(i), m.ReadAt(addr+uint16(i)))
+	m.dma.nextSource = uint16(value) << 8
+	if m.dma.nextSource >= 0xE000 {
+		// There's no echo of OAM and IO, 0xE000 and up read from work RAM
+		m.dma.nextSource -= 0x2000
 	}
+	m.dma.startDelay = 4
 }
 
-func (m *mmu) ReadJoypadInput(value uint8) uint8 {
-	if GetBit(value, 4) == 0 { // Get direction key inputs
-		for {
-			select {
-			case keyPress := <-m.directionKeyEvents:
-				if keyPress.Action == glfw.Release {
-					m.lastKeyPress = 0xEF
-				} else if keyPress.Action == glfw.Press {
-					if keyPress.Key == glfw.KeyDown {
-						m.lastKeyPress = 0xE7
-					} else if keyPress.Key == glfw.KeyUp {
-						m.lastKeyPress = 0xEB
-					} else if keyPress.Key == glfw.KeyLeft {
-						m.lastKeyPress = 0xED
-					} else if keyPress.Key == glfw.KeyRight {
-						m.lastKeyPress = 0xEE
-					} else {
-						m.lastKeyPress = 0xEF
-					}
-				}
-			default:
-				if m.lastKeyPress != 0xDF && m.lastKeyPress != 0xEF {
-					fmt.Printf("%x\n", m.lastKeyPress)
-				}
-				return m.lastKeyPress
-			}
-			// bit 3 - down
-			// bit 2 - up
-			// bit 1 - left
-			// bit 0 - right
+func (m *mmu) tickDMA() {
+	if m.dma.active {
+		m.dma.ticks += 1
+		if m.dma.ticks == 4 {
+			m.dma.ticks = 0
+			m.copyDMAByte()
 		}
-	} else { // Get button keys input
-		for {
-			select {
-			case keyPress := <-m.buttonKeyEvents:
-				if keyPress.Action == glfw.Release {
-					m.lastKeyPress = 0xDF
-				} else if keyPress.Action == glfw.Press {
-					if keyPress.Key == glfw.KeyRightControl {
-						m.lastKeyPress = 0xD7
-					} else if keyPress.Key == glfw.KeyRightShift {
-						m.lastKeyPress = 0xDB
-					} else if keyPress.Key == glfw.KeyBackspace {
-						m.lastKeyPress = 0xDD
-					} else if keyPress.Key == glfw.KeyEnter {
-						m.lastKeyPress = 0xDE
-					} else {
-						m.lastKeyPress = 0xDF
-					}
-				}
-			default:
-				if m.lastKeyPress != 0xDF && m.lastKeyPress != 0xEF {
-					fmt.Printf("%x\n", m.lastKeyPress)
-				}
-				return m.lastKeyPress
-			}
-			// bit 3 - start
-			// bit 2 - select
-			// bit 1 - B
-			// bit 0 - A
+	}
+
+	if m.dma.startDelay > 0 {
+		m.dma.startDelay -= 1
+		if m.dma.startDelay == 0 {
+			m.dma.active = true
+			m.dma.source = m.dma.nextSource
+			m.dma.index = 0
+			m.dma.ticks = 0
 		}
 	}
 }
+
+func (m *mmu) copyDMAByte() {
+	addr := m.dma.source + uint16(m.dma.index)
+	if m.codeDataLogger != nil && addr <= 0x7FFF {
+		m.codeDataLogger.Log(ROMOffset(addr, m.ROMBank()), CDL_DMA)
+	}
+	m.dma.value = m.read(addr)
+	m.OAM[m.dma.index] = m.dma.value
+	m.dma.index += 1
+	if m.dma.index == len(m.OAM) {
+		m.dma.active = false
+	}
+}
+
+// SetLineDot is called by the display after every dot so the CPU sees the dot
+// it runs in
+func (m *mmu) SetLineDot(dot int) {
+	m.lineDot = dot
+}
+
+// CorruptOAM emulates the DMG OAM bug. When the CPU puts an address in
+// 0xFE00 - 0xFEFF on the bus or through the 16-bit inc/dec unit during the OAM
+// search, the row of OAM the PPU is reading gets mixed with the row before.
+// OAM is 20 rows of 4 words and the PPU reads one row per M-cycle, so cycle is
+// the M-cycle of the instruction the access happens in. The CPU runs a whole
+// instruction at once at its end, so the row is counted from the opcode fetch.
+func (m *mmu) CorruptOAM(address uint16, access OAMBugAccess, cycle int) {
+	if address < 0xFE00 || address > 0xFEFF || m.dma.active {
+		return
+	}
+	// The instruction may have run on into pixel transfer, the row decides
+	// whether the access itself was during the OAM search
+	if mode := m.IoPorts[LCDC_STATUS-0xFF00] & 0x03; mode != OAM_SEARCH_MODE && mode != PIXEL_TRANSFER_MODE {
+		return
+	}
+	start := m.instructionDot
+	if start > m.lineDot {
+		start -= TICKS_PER_LINE // Fetched on the previous line
+	}
+	row := (start+TICKS_PER_LINE)/4 - TICKS_PER_LINE/4 + cycle
+	if row <= 0 || row >= OAM_ROWS {
+		return // The first row is never corrupted
+	}
+
+	switch access {
+	case OAM_BUG_WRITE:
+		a, b, c := m.oamWord(row, 0), m.oamWord(row-1, 0), m.oamWord(row-1, 2)
+		m.setOAMWord(row, 0, ((a^c)&(b^c))^c)
+		copy(m.OAM[row*8+2:row*8+8], m.OAM[row*8-6:row*8])
+	case OAM_BUG_READ_INC_DEC:
+		if row >= 4 && row < OAM_ROWS-1 {
+			a, b, c, d := m.oamWord(row-2, 0), m.oamWord(row-1, 0), m.oamWord(row, 0), m.oamWord(row-1, 2)
+			m.setOAMWord(row-1, 0, (b&(a|c|d))|(a&c&d))
+			copy(m.OAM[row*8:row*8+8], m.OAM[row*8-8:row*8])
+			copy(m.OAM[row*8-16:row*8-8], m.OAM[row*8-8:row*8])
+		}
+		fallthrough
+	case OAM_BUG_READ:
+		a, b, c := m.oamWord(row, 0), m.oamWord(row-1, 0), m.oamWord(row-1, 2)
+		m.setOAMWord(row, 0, b|(a&c))
+		copy(m.OAM[row*8+2:row*8+8], m.OAM[row*8-6:row*8])
+	}
+}
+
+func (m *mmu) oamWord(row, word int) uint16 {
+	i := row*8 + word*2
+	return uint16(m.OAM[i]) | uint16(m.OAM[i+1])<<8
+}
+
+func (m *mmu) setOAMWord(row, word int, value uint16) {
+	i := row*8 + word*2
+	m.OAM[i] = uint8(value)
+	m.OAM[i+1] = uint8(value >> 8)
+}
+
+// P1 (0xFF00):
+//
+//	bits 7-6 - unused, always read as 1
+//	bit 5    - P15, select the buttons when 0
+//	bit 4    - P14, select the directions when 0
+//	bits 3-0 - P13-P10, 0 while a button on a selected line is held:
+//	           Down/Start, Up/Select, Left/B, Right/A
+//
+// With both groups selected a line is low if either of its buttons is held.
+func (m *mmu) ReadJoypadInput(value uint8) uint8 {
+	return 0xC0 | value&0x30 | m.joypadLines(value)
+}
+
+func (m *mmu) joypadLines(value uint8) uint8 {
+	var pressed uint8
+	if GetBit(value, 4) == 0 {
+		pressed |= m.joypadGroup(BUTTON_RIGHT, BUTTON_LEFT, BUTTON_UP, BUTTON_DOWN)
+	}
+	if GetBit(value, 5) == 0 {
+		pressed |= m.joypadGroup(BUTTON_A, BUTTON_B, BUTTON_SELECT, BUTTON_START)
+	}
+	return ^pressed & 0x0F
+}
+
+// joypadGroup returns a bit per held button, P10 first
+func (m *mmu) joypadGroup(p10, p11, p12, p13 Button) uint8 {
+	var pressed uint8
+	for i, button := range [4]Button{p10, p11, p12, p13} {
+		if m.buttons.Pressed(button) {
+			pressed |= 1 << uint(i)
+		}
+	}
+	return pressed
+}
+
+// The joypad interrupt is requested when any of P10-P13 goes from high to low
+func (m *mmu) checkJoypadInterrupt(previous uint8) {
+	if previous&^m.joypadLines(m.IoPorts[0]) != 0 {
+		m.FireInterrupt(JOYPAD_INTERRUPT)
+	}
+}
+
+// The ROM isn't saved, states are only ever loaded into the same ROM
+func (m *mmu) SaveState(w *StateWriter) {
+	w.WriteBytes(m.VRAM[:])
+	w.WriteBytes(m.SwitchableRAM[:])
+	w.WriteBytes(m.InternalRAM[:])
+	w.WriteBytes(m.EchoRAM[:])
+	w.WriteBytes(m.OAM[:])
+	w.WriteBytes(m.Unused[:])
+	w.WriteBytes(m.IoPorts[:])
+	w.WriteBytes(m.HRAM[:])
+	w.WriteUint8(m.InterruptEnable)
+	w.WriteUint8(uint8(m.buttons))
+	w.WriteBool(m.dma.active)
+	w.WriteUint16(m.dma.source)
+	w.WriteInt(m.dma.index)
+	w.WriteInt(m.dma.ticks)
+	w.WriteUint8(m.dma.value)
+	w.WriteInt(m.dma.startDelay)
+	w.WriteUint16(m.dma.nextSource)
+	w.WriteInt(m.lineDot)
+	w.WriteInt(m.instructionDot)
+}
+
+func (m *mmu) LoadState(r *StateReader) {
+	r.ReadBytes(m.VRAM[:])
+	r.ReadBytes(m.SwitchableRAM[:])
+	r.ReadBytes(m.InternalRAM[:])
+	r.ReadBytes(m.EchoRAM[:])
+	r.ReadBytes(m.OAM[:])
+	r.ReadBytes(m.Unused[:])
+	r.ReadBytes(m.IoPorts[:])
+	r.ReadBytes(m.HRAM[:])
+	m.InterruptEnable = r.ReadUint8()
+	m.buttons = ButtonState(r.ReadUint8())
+	m.dma.active = r.ReadBool()
+	m.dma.source = r.ReadUint16()
+	m.dma.index = r.ReadCount(len(m.OAM))
+	m.dma.ticks = r.ReadInt()
+	m.dma.value = r.ReadUint8()
+	m.dma.startDelay = r.ReadInt()
+	m.dma.nextSource = r.ReadUint16()
+	m.dma.active = m.dma.active && m.dma.index < len(m.OAM)
+	m.lineDot = r.ReadInt()
+	m.instructionDot = r.ReadInt()
+}
@@ -0,0 +1,363 @@
+package gbemu
+
+import "testing"
+
+func TestOAMBugPush(t *testing.T) {
+	tests := []struct {
+		name   string
+		sp     uint16
+		mode   uint8
+		dot    int
+		copied map[int]int // Rows that end up as a copy of another row
+	}{
+		{"SP in OAM", 0xFE40, OAM_SEARCH_MODE, 16, map[int]int{5: 4, 6: 4, 7: 4}},
+		{"only the first decrement in OAM", 0xFE00, OAM_SEARCH_MODE, 16, map[int]int{5: 4}},
+		{"only the writes in OAM", 0xFF00, OAM_SEARCH_MODE, 16, map[int]int{6: 5, 7: 5}},
+		{"just below OAM", 0xFDFF, OAM_SEARCH_MODE, 16, map[int]int{}},
+		{"pixel transfer", 0xFE40, PIXEL_TRANSFER_MODE, 80, map[int]int{}},
+		{"past the last row", 0xFE40, OAM_SEARCH_MODE, 76, map[int]int{}},
+	}
+
+	for _, test := range tests {
+		m := CreateMMU().(*mmu)
+		for i := range m.OAM {
+			m.OAM[i] = uint8(i)
+		}
+		original := m.OAM
+		m.SetLCDStatusMode(test.mode)
+		m.SetLineDot(test.dot)
+		m.FetchInstructionByte(0xC000, false)
+
+		regs := CreateRegisters(m)
+		regs.WriteSP(test.sp)
+		CreateInstructions(regs, m, nil)[0xC5].Execute(Parameters{})
+
+		for row := 0; row < OAM_ROWS; row++ {
+			source, ok := test.copied[row]
+			if !ok {
+				source = row
+			}
+			for i := 0; i < 8; i++ {
+				if got, want := m.OAM[row*8+i], original[source*8+i]; got != want {
+					t.Errorf("%s: OAM[%d] = %d, want %d", test.name, row*8+i, got, want)
+				}
+			}
+		}
+	}
+}
+
+// The CPU executes an instruction after its last cycle, so the rows are
+// counted from where its opcode was fetched
+func TestOAMBugPushTiming(t *testing.T) {
+	rom := make([]byte, 0x8000)
+	copy(rom[0x100:], []byte{0x31, 0x40, 0xFE, 0xC3, 0x00, 0xC0}) // LD SP,FE40; JP C000
+	m := CreateMMU()
+	m.Reset()
+	m.InitRom(rom)
+	c := CreateCPU(m)
+	c.Reset()
+	d := CreateDisplay(m)
+	// JR to itself until the test lets it through to the PUSH
+	for i, b := range []uint8{0x18, 0xFE, 0xC5, 0x18, 0xFE} { // JR -2; PUSH BC; JR -2
+		m.PokeAt(0xC000+uint16(i), b)
+	}
+	for i := range m.(*mmu).OAM {
+		m.(*mmu).OAM[i] = uint8(i)
+	}
+	original := m.(*mmu).OAM
+
+	fetchDot := -1
+	for i := 0; i < 2*TICKS_PER_LINE && c.Registers().ReadPC() != 0xC003; i++ {
+		if d.CurrentLine() == 1 && m.LCDStatusMode() == OAM_SEARCH_MODE && m.(*mmu).lineDot == 8 {
+			m.PokeAt(0xC001, 0x00)
+		}
+		dot := m.(*mmu).lineDot
+		fetched := c.(*cpu).currentOpcode == 0xC5
+		c.Tick()
+		m.Tick()
+		d.Tick()
+		if !fetched && c.(*cpu).currentOpcode == 0xC5 {
+			fetchDot = dot
+		}
+	}
+	if fetchDot < 0 || c.Registers().ReadPC() != 0xC003 {
+		t.Fatalf("PUSH never ran")
+	}
+	if fetchDot/4+3 >= OAM_SEARCH_TICKS/4 {
+		t.Fatalf("PUSH fetched at dot %d, too late in the OAM search", fetchDot)
+	}
+
+	row := fetchDot / 4
+	for r := 0; r < OAM_ROWS; r++ {
+		source := r
+		if r > row && r <= row+3 {
+			source = row
+		}
+		for i := 0; i < 8; i++ {
+			if got, want := m.(*mmu).OAM[r*8+i], original[source*8+i]; got != want {
+				t.Errorf("PUSH fetched at dot %d: OAM[%d] = %d, want %d", fetchDot, r*8+i, got, want)
+			}
+		}
+	}
+}
+
+// The CPU runs before the display each tick, so it has to see the dot it's in
+// and not the one the display ran last
+func TestOAMBugLineDot(t *testing.T) {
+	m := CreateMMU()
+	m.Reset()
+	d := CreateDisplay(m)
+	for m.LCDStatusMode() != HBLANK_MODE {
+		d.Tick()
+	}
+	for m.LCDStatusMode() != OAM_SEARCH_MODE {
+		d.Tick()
+	}
+	if dot := m.(*mmu).lineDot; dot != 0 {
+		t.Errorf("line dot at the start of the OAM search = %d, want 0", dot)
+	}
+}
+
+func TestDMARestart(t *testing.T) {
+	m := CreateMMU()
+	for i := uint16(0); i < 0xA0; i++ {
+		m.WriteByte(0xC000+i, 0x10)
+		m.WriteByte(0xD000+i, 0x20)
+	}
+
+	m.WriteByte(DMA_TRANSFER_ADDRESS, 0xC0)
+	for i := 0; i < 4+4*10; i++ {
+		m.Tick()
+	}
+	m.WriteByte(DMA_TRANSFER_ADDRESS, 0xD0)
+	for i := 0; i < 4; i++ {
+		if m.ReadAt(0xFF80) != 0 || m.ReadAt(0xFE00) != 0xFF {
+			t.Fatalf("OAM not blocked %d ticks after restarting DMA", i)
+		}
+		m.Tick()
+	}
+	// The old transfer copies another byte while the new one starts up
+	if got := m.ReadVideoMemory(0xFE0A); got != 0xFF {
+		t.Errorf("PPU read OAM during DMA = %02X, want FF", got)
+	}
+	if got := m.(*mmu).OAM[10]; got != 0x10 {
+		t.Errorf("OAM[10] = %02X during the restart, want 10", got)
+	}
+
+	for i := 0; i < 4*0xA0; i++ {
+		m.Tick()
+	}
+	if got := m.ReadAt(0xFE00); got != 0x20 {
+		t.Errorf("OAM[0] = %02X after the restarted DMA, want 20", got)
+	}
+	if got := m.ReadAt(0xFE9F); got != 0x20 {
+		t.Errorf("OAM[9F] = %02X after the restarted DMA, want 20", got)
+	}
+}
+
+func TestHostAccessIgnoresLockout(t *testing.T) {
+	m := CreateMMU()
+	m.SetLCDStatusMode(PIXEL_TRANSFER_MODE)
+	m.PokeAt(0x8000, 0x12)
+	m.PokeAt(0xFE00, 0x34)
+	if got := m.PeekAt(0x8000); got != 0x12 {
+		t.Errorf("PeekAt(8000) in mode 3 = %02X, want 12", got)
+	}
+	if got := m.PeekAt(0xFE00); got != 0x34 {
+		t.Errorf("PeekAt(FE00) in mode 3 = %02X, want 34", got)
+	}
+	if got := m.ReadAt(0x8000); got != 0xFF {
+		t.Errorf("CPU read of VRAM in mode 3 = %02X, want FF", got)
+	}
+
+	m.FireInterrupt(VBLANK_INTERRUPT)
+	m.WriteByte(INTERRUPT_ENABLE, 0x01)
+	if !m.HasPendingInterrupt() {
+		t.Errorf("VBlank interrupt not pending after FireInterrupt")
+	}
+}
+
+func TestJoypadMatrix(t *testing.T) {
+	held := func(buttons ...Button) ButtonState {
+		var state ButtonState
+		for _, button := range buttons {
+			state = state.With(button, true)
+		}
+		return state
+	}
+
+	tests := []struct {
+		name    string
+		lines   uint8
+		buttons ButtonState
+		want    uint8
+	}{
+		{"nothing selected", 0x30, held(BUTTON_A, BUTTON_RIGHT), 0xFF},
+		{"directions, none held", 0x20, held(), 0xEF},
+		{"directions, right", 0x20, held(BUTTON_RIGHT), 0xEE},
+		{"directions, down and left", 0x20, held(BUTTON_DOWN, BUTTON_LEFT), 0xE5},
+		{"directions ignore buttons", 0x20, held(BUTTON_A, BUTTON_START), 0xEF},
+		{"buttons, A", 0x10, held(BUTTON_A), 0xDE},
+		{"buttons, select and start", 0x10, held(BUTTON_SELECT, BUTTON_START), 0xD3},
+		{"buttons ignore directions", 0x10, held(BUTTON_UP), 0xDF},
+		{"both, A and right share P10", 0x00, held(BUTTON_A, BUTTON_RIGHT), 0xCE},
+		{"both, B and up", 0x00, held(BUTTON_B, BUTTON_UP), 0xC9},
+		{"both, everything", 0x00, held(BUTTON_A, BUTTON_B, BUTTON_SELECT, BUTTON_START, BUTTON_RIGHT, BUTTON_LEFT, BUTTON_UP, BUTTON_DOWN), 0xC0},
+		{"low bits aren't writable", 0x2F, held(), 0xEF},
+	}
+
+	for _, test := range tests {
+		m := CreateMMU()
+		m.SetButtons(test.buttons)
+		m.WriteByte(JOYPAD_INPUT, test.lines)
+		if got := m.ReadAt(JOYPAD_INPUT); got != test.want {
+			t.Errorf("%s: P1 = %02X, want %02X", test.name, got, test.want)
+		}
+	}
+}
+
+func TestJoypadInterrupt(t *testing.T) {
+	tests := []struct {
+		name   string
+		lines  uint8
+		button Button
+		fires  bool
+	}{
+		{"direction selected", 0x20, BUTTON_UP, true},
+		{"direction not selected", 0x10, BUTTON_UP, false},
+		{"button selected", 0x10, BUTTON_START, true},
+		{"nothing selected", 0x30, BUTTON_A, false},
+	}
+
+	for _, test := range tests {
+		m := CreateMMU()
+		m.WriteByte(JOYPAD_INPUT, test.lines)
+		m.WriteByte(INTERRUPT_FLAGS, 0x00)
+		m.SetButtons(ButtonState(0).With(test.button, true))
+		fired := m.ReadAt(INTERRUPT_FLAGS)&(1<<uint(JOYPAD_INTERRUPT)) != 0
+		if fired != test.fires {
+			t.Errorf("%s: joypad interrupt fired = %v, want %v", test.name, fired, test.fires)
+		}
+	}
+
+	// Selecting a line with a button already held also pulls it low
+	m := CreateMMU()
+	m.WriteByte(JOYPAD_INPUT, 0x30)
+	m.SetButtons(ButtonState(0).With(BUTTON_A, true))
+	m.WriteByte(INTERRUPT_FLAGS, 0x00)
+	m.WriteByte(JOYPAD_INPUT, 0x10)
+	if m.ReadAt(INTERRUPT_FLAGS)&(1<<uint(JOYPAD_INTERRUPT)) == 0 {
+		t.Errorf("joypad interrupt didn't fire when selecting a line with a button held")
+	}
+}
+
+func TestAccessLockout(t *testing.T) {
+	tests := []struct {
+		mode    uint8
+		address uint16
+		blocked bool
+	}{
+		{HBLANK_MODE, 0x8000, false},
+		{HBLANK_MODE, 0xFE00, false},
+		{VBLANK_MODE, 0x9FFF, false},
+		{VBLANK_MODE, 0xFE9F, false},
+		{OAM_SEARCH_MODE, 0x8000, false},
+		{OAM_SEARCH_MODE, 0xFE00, true},
+		{OAM_SEARCH_MODE, 0xFE9F, true},
+		{PIXEL_TRANSFER_MODE, 0x8000, true},
+		{PIXEL_TRANSFER_MODE, 0x9FFF, true},
+		{PIXEL_TRANSFER_MODE, 0xFE00, true},
+		{PIXEL_TRANSFER_MODE, 0xC000, false},
+		{PIXEL_TRANSFER_MODE, 0xFF80, false},
+	}
+
+	for _, blocking := range []bool{true, false} {
+		for _, test := range tests {
+			m := CreateMMU()
+			m.SetAccessBlocking(blocking)
+			m.PokeAt(test.address, 0x12)
+			m.SetLCDStatusMode(test.mode)
+			blocked := test.blocked && blocking
+
+			read := m.ReadAt(test.address)
+			if blocked && read != 0xFF || !blocked && read != 0x12 {
+				t.Errorf("blocking %v: read of %04X in mode %d = %02X", blocking, test.address, test.mode, read)
+			}
+			m.WriteByte(test.address, 0x34)
+			written := m.PeekAt(test.address)
+			if blocked && written != 0x12 || !blocked && written != 0x34 {
+				t.Errorf("blocking %v: write to %04X in mode %d left %02X", blocking, test.address, test.mode, written)
+			}
+		}
+	}
+}
+
+func TestDMALockout(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  uint8
+		address uint16
+		want    uint8 // 0 for the byte DMA is copying
+	}{
+		{"ROM from WRAM", 0xC0, 0x0150, 0},
+		{"WRAM from WRAM", 0xC0, 0xD000, 0},
+		{"external RAM from WRAM", 0xC0, 0xA000, 0},
+		{"VRAM from WRAM", 0xC0, 0x8000, 0xFF},
+		{"WRAM from VRAM", 0x80, 0xC000, 0xFF},
+		{"VRAM from VRAM", 0x80, 0x9000, 0},
+		{"OAM", 0xC0, 0xFE00, 0xFF},
+		{"HRAM", 0xC0, 0xFF80, 0x56},
+		{"IO", 0xC0, SCROLL_X, 0x56},
+	}
+
+	for _, test := range tests {
+		m := CreateMMU()
+		source := uint16(test.source) << 8
+		for i := uint16(0); i < 0xA0; i++ {
+			m.PokeAt(source+i, uint8(0x40+i))
+		}
+		m.PokeAt(test.address, 0x56)
+
+		// Start up and copy 3 bytes
+		m.WriteByte(DMA_TRANSFER_ADDRESS, test.source)
+		for i := 0; i < 4+4*3; i++ {
+			m.Tick()
+		}
+		want := test.want
+		if want == 0 {
+			want = 0x42
+		}
+		if got := m.ReadAt(test.address); got != want {
+			t.Errorf("%s: read of %04X during DMA = %02X, want %02X", test.name, test.address, got, want)
+		}
+
+		m.WriteByte(test.address, 0x78)
+		written := m.PeekAt(test.address) == 0x78
+		if test.address >= 0xFF00 != written {
+			t.Errorf("%s: write to %04X during DMA went through = %v", test.name, test.address, written)
+		}
+	}
+}
+
+// The CPU is locked out for the 640 ticks DMA spends copying, starting 4
+// ticks after the write to FF46
+func TestDMALockoutWindow(t *testing.T) {
+	m := CreateMMU()
+	m.PokeAt(0xC100, 0x12)
+	m.PokeAt(0xFE00, 0x34)
+
+	m.WriteByte(DMA_TRANSFER_ADDRESS, 0xC0)
+	for tick := 0; tick < 4+4*0xA0+4; tick++ {
+		blocked := tick >= 4 && tick < 4+4*0xA0
+		if got := m.ReadAt(0xC100) != 0x12; got != blocked {
+			t.Errorf("tick %d: WRAM blocked = %v, want %v", tick, got, blocked)
+		}
+		if got := m.ReadAt(0xFE00) == 0xFF; got != blocked {
+			t.Errorf("tick %d: OAM blocked = %v, want %v", tick, got, blocked)
+		}
+		if got := m.ReadVideoMemory(0xFE00) == 0xFF; got != blocked {
+			t.Errorf("tick %d: OAM blocked for the PPU = %v, want %v", tick, got, blocked)
+		}
+		m.Tick()
+	}
+}
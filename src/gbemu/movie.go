@@ -0,0 +1,120 @@
+package gbemu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Input movies record the buttons held during every frame so a run can be
+// played back exactly, e.g. as a regression test or to reproduce a bug.
+// All integers are little endian:
+//
+//	[8]byte  magic "GBEMUMOV"
+//	uint16   format version (MOVIE_VERSION)
+//	uint16   length of the emulator version string, followed by the string
+//	[16]byte ROM title, uint16 ROM global checksum, uint32 ROM CRC-32
+//	uint32   length of the start state, 0 when the movie starts at power on,
+//	         followed by a complete save state (see savestate.go)
+//	uint32   number of frames, followed by one ButtonState byte per frame
+//	uint32   CRC-32 of everything before it
+const (
+	MOVIE_MAGIC   string = "GBEMUMOV"
+	MOVIE_VERSION uint16 = 1
+)
+
+type Movie struct {
+	EmulatorVersion string
+	ROM             ROMIdentity
+	StartState      []byte // nil when starting from power on
+	Frames          []ButtonState
+}
+
+func (m *Movie) Write(w io.Writer) error {
+	var buffer bytes.Buffer
+	buffer.WriteString(MOVIE_MAGIC)
+	binary.Write(&buffer, binary.LittleEndian, MOVIE_VERSION)
+	binary.Write(&buffer, binary.LittleEndian, uint16(len(m.EmulatorVersion)))
+	buffer.WriteString(m.EmulatorVersion)
+	buffer.Write(m.ROM.Title[:])
+	binary.Write(&buffer, binary.LittleEndian, m.ROM.GlobalChecksum)
+	binary.Write(&buffer, binary.LittleEndian, m.ROM.Checksum)
+	binary.Write(&buffer, binary.LittleEndian, uint32(len(m.StartState)))
+	buffer.Write(m.StartState)
+	binary.Write(&buffer, binary.LittleEndian, uint32(len(m.Frames)))
+	for _, frame := range m.Frames {
+		buffer.WriteByte(uint8(frame))
+	}
+	binary.Write(&buffer, binary.LittleEndian, crc32.ChecksumIEEE(buffer.Bytes()))
+
+	if _, err := w.Write(buffer.Bytes()); err != nil {
+		return fmt.Errorf("ERROR writing movie: %s", err)
+	}
+	return nil
+}
+
+func ReadMovie(r io.Reader) (*Movie, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR reading movie: %s", err)
+	}
+	if len(data) < len(MOVIE_MAGIC)+4 || string(data[:len(MOVIE_MAGIC)]) != MOVIE_MAGIC {
+		return nil, fmt.Errorf("ERROR not a movie file")
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return nil, fmt.Errorf("ERROR movie is corrupt (checksum mismatch)")
+	}
+
+	reader := CreateStateReader(body[len(MOVIE_MAGIC):])
+	if version := reader.ReadUint16(); version != MOVIE_VERSION {
+		return nil, fmt.Errorf("ERROR movie version %d is not supported (expected %d)", version, MOVIE_VERSION)
+	}
+	movie := &Movie{}
+	emulatorVersion := make([]byte, reader.ReadUint16())
+	reader.ReadBytes(emulatorVersion)
+	movie.EmulatorVersion = string(emulatorVersion)
+	reader.ReadBytes(movie.ROM.Title[:])
+	movie.ROM.GlobalChecksum = reader.ReadUint16()
+	movie.ROM.Checksum = reader.ReadUint32()
+	if length := int(reader.ReadUint32()); length > reader.Remaining() {
+		return nil, fmt.Errorf("ERROR movie start state is truncated")
+	} else if length > 0 {
+		movie.StartState = make([]byte, length)
+		reader.ReadBytes(movie.StartState)
+	}
+	frames := int(reader.ReadUint32())
+	if frames != reader.Remaining() {
+		return nil, fmt.Errorf("ERROR movie has %d bytes of input for %d frames", reader.Remaining(), frames)
+	}
+	movie.Frames = make([]ButtonState, frames)
+	for i := range movie.Frames {
+		movie.Frames[i] = ButtonState(reader.ReadUint8())
+	}
+	if err := reader.Err(); err != nil {
+		return nil, fmt.Errorf("ERROR reading movie: %s", err)
+	}
+	return movie, nil
+}
+
+func LoadMovieFile(filename string) (*Movie, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR opening movie: %s", err)
+	}
+	defer f.Close()
+	return ReadMovie(f)
+}
+
+func (m *Movie) WriteFile(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("ERROR creating movie: %s", err)
+	}
+	defer f.Close()
+	return m.Write(f)
+}
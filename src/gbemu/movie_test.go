@@ -0,0 +1,101 @@
+package gbemu
+
+import (
+	"bytes"
+	"testing"
+)
+
+// inputTestROM keeps reading the buttons and folds them into C and a ring of
+// WRAM, so any difference in input changes the state
+func inputTestROM() []byte {
+	rom := make([]byte, 0x8000)
+	copy(rom[0x100:], []byte{
+		0x3E, 0x10, // LD A,10 - select the buttons
+		0xE0, 0x00, // LDH (00),A
+		0x21, 0x00, 0xC0, // LD HL,C000
+		0xF0, 0x00, // loop: LDH A,(00)
+		0x81,       // ADD A,C
+		0x4F,       // LD C,A
+		0x22,       // LD (HL+),A
+		0x7C,       // LD A,H
+		0xE6, 0x03, // AND 03
+		0xF6, 0xC0, // OR C0
+		0x67,       // LD H,A
+		0x18, 0xF3, // JR loop
+	})
+	copy(rom[0x134:], "INPUT")
+	return rom
+}
+
+func saveStateBytes(t *testing.T, e *Emulator) []byte {
+	var state bytes.Buffer
+	if err := e.SaveState(&state); err != nil {
+		t.Fatal(err)
+	}
+	return state.Bytes()
+}
+
+func TestMoviePlayback(t *testing.T) {
+	script := func(frame int) ButtonState {
+		return ButtonState(0).With(BUTTON_A, frame%3 == 0).With(BUTTON_START, frame%7 < 2).With(BUTTON_B, frame > 10)
+	}
+
+	tests := []struct {
+		name   string
+		warmup int // Cycles run before recording, so the movie embeds a start state
+	}{
+		{"from power on", 0},
+		{"from a start state", 12345},
+	}
+
+	for _, test := range tests {
+		recorder := newTestEmulator(t, inputTestROM())
+		recorder.RunCycles(test.warmup)
+		if err := recorder.RecordMovie(); err != nil {
+			t.Fatal(err)
+		}
+		for frame := 0; frame < 20; frame++ {
+			recorder.SetButtons(script(frame))
+			recorder.RunFrame()
+		}
+		movie := recorder.StopRecording()
+		want := saveStateBytes(t, recorder)
+		if (movie.StartState != nil) != (test.warmup != 0) {
+			t.Errorf("%s: movie has a start state = %v", test.name, movie.StartState != nil)
+		}
+
+		var file bytes.Buffer
+		if err := movie.Write(&file); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := ReadMovie(&file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		player := newTestEmulator(t, inputTestROM())
+		if err := player.PlayMovie(loaded); err != nil {
+			t.Fatal(err)
+		}
+		for player.MoviePlaying() {
+			player.SetButtons(ButtonState(0xFF)) // Ignored during playback
+			player.RunFrame()
+		}
+		if !bytes.Equal(saveStateBytes(t, player), want) {
+			t.Errorf("%s: state after playing the movie back differs from the recording", test.name)
+		}
+
+		// Make sure the input actually matters
+		loaded.Frames[5] ^= ButtonState(0).With(BUTTON_SELECT, true)
+		other := newTestEmulator(t, inputTestROM())
+		if err := other.PlayMovie(loaded); err != nil {
+			t.Fatal(err)
+		}
+		for other.MoviePlaying() {
+			other.RunFrame()
+		}
+		if bytes.Equal(saveStateBytes(t, other), want) {
+			t.Errorf("%s: state doesn't depend on the input", test.name)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package gbemu
 
 import "fmt"
 
@@ -12,6 +12,7 @@ type SpriteAttribute interface {
 	HorizontalFlip() bool
 	VerticalFlip() bool
 	PaletteNumber() int
+	Bytes() [4]uint8
 }
 
 type spriteAttribute struct {
@@ -77,3 +78,26 @@ func (s SortableSpriteAttribute) Len() int {
 func (s SortableSpriteAttribute) Swap(i, j int) {
 	s[i], s[j] = s[j], s[i]
 }
+
+func (s *spriteAttribute) Bytes() [4]uint8 {
+	return [4]uint8{s.yPosition, s.xPosition, s.tileNumber, s.flags}
+}
+
+// Sprite attributes in save states are a presence flag followed by the 4 OAM
+// bytes, since the PPU uses nil for "no sprite"
+func writeSpriteAttribute(w *StateWriter, sprite SpriteAttribute) {
+	w.WriteBool(sprite != nil)
+	if sprite != nil {
+		b := sprite.Bytes()
+		w.WriteBytes(b[:])
+	}
+}
+
+func readSpriteAttribute(r *StateReader) SpriteAttribute {
+	if !r.ReadBool() {
+		return nil
+	}
+	b := make([]uint8, 4)
+	r.ReadBytes(b)
+	return fromBytes(b)
+}
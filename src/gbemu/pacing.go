@@ -0,0 +1,130 @@
+package gbemu
+
+import (
+	"time"
+)
+
+const (
+	CLOCK_SPEED_HZ   int           = 4194304
+	CLOCK_TICK_NANOS time.Duration = time.Second / time.Duration(CLOCK_SPEED_HZ)
+	// 70224 ticks at 4.194304 MHz, ~59.73 frames per second
+	FRAME_DURATION time.Duration = time.Duration(TICKS_PER_REFRESH) * time.Second / time.Duration(CLOCK_SPEED_HZ)
+	// How far behind the pacer is allowed to fall (e.g. after the host stalled)
+	// before it gives up on catching up and starts pacing from now
+	MAX_PACING_LAG time.Duration = 4 * FRAME_DURATION
+)
+
+// The FramePacer keeps emulation running at real hardware speed by sleeping
+// after every frame until that frame's deadline. Deadlines are absolute so
+// oversleeping on one frame is made up for on the next ones instead of
+// accumulating. A speed of 0 means uncapped.
+type FramePacer interface {
+	ShouldRunFrame() bool
+	Wait()
+	SetSpeed(float64)
+	Speed() float64
+	SetFastForward(bool)
+	SetSlowMotion(bool)
+	TogglePause()
+	Paused() bool
+	AdvanceFrame()
+}
+
+type framePacer struct {
+	speed            float64
+	fastForwardSpeed float64
+	slowMotionSpeed  float64
+	fastForward      bool
+	slowMotion       bool
+	paused           bool
+	advance          bool
+	deadline         time.Time
+}
+
+func CreateFramePacer(speed, fastForwardSpeed, slowMotionSpeed float64) FramePacer {
+	return &framePacer{
+		speed:            speed,
+		fastForwardSpeed: fastForwardSpeed,
+		slowMotionSpeed:  slowMotionSpeed,
+		deadline:         time.Now(),
+	}
+}
+
+// ShouldRunFrame is false while paused, except for a single frame after
+// AdvanceFrame
+func (p *framePacer) ShouldRunFrame() bool {
+	if !p.paused {
+		return true
+	}
+	if p.advance {
+		p.advance = false
+		return true
+	}
+	return false
+}
+
+func (p *framePacer) Wait() {
+	if p.paused {
+		// Keep the frontend responsive without spinning
+		time.Sleep(FRAME_DURATION)
+		p.deadline = time.Now()
+		return
+	}
+
+	speed := p.Speed()
+	now := time.Now()
+	if speed <= 0 {
+		p.deadline = now
+		return
+	}
+
+	p.deadline = p.deadline.Add(time.Duration(float64(FRAME_DURATION) / speed))
+	if lag := now.Sub(p.deadline); lag > MAX_PACING_LAG {
+		p.deadline = now
+		return
+	}
+	if wait := p.deadline.Sub(now); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+func (p *framePacer) SetSpeed(speed float64) {
+	p.speed = speed
+	p.deadline = time.Now()
+}
+
+// Speed is the current multiple of real hardware speed
+func (p *framePacer) Speed() float64 {
+	if p.fastForward {
+		return p.fastForwardSpeed
+	} else if p.slowMotion {
+		return p.slowMotionSpeed
+	}
+	return p.speed
+}
+
+func (p *framePacer) SetFastForward(enabled bool) {
+	p.fastForward = enabled
+	p.deadline = time.Now()
+}
+
+func (p *framePacer) SetSlowMotion(enabled bool) {
+	p.slowMotion = enabled
+	p.deadline = time.Now()
+}
+
+func (p *framePacer) TogglePause() {
+	p.paused = !p.paused
+	p.deadline = time.Now()
+}
+
+func (p *framePacer) Paused() bool {
+	return p.paused
+}
+
+// AdvanceFrame runs exactly one more frame while paused
+func (p *framePacer) AdvanceFrame() {
+	if p.paused {
+		p.advance = true
+	}
+}
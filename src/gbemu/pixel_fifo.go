@@ -0,0 +1,90 @@
+package gbemu
+
+type PixelSource uint8
+
+const (
+	SOURCE_BACKGROUND PixelSource = iota
+	SOURCE_WINDOW
+	SOURCE_SPRITE
+)
+
+// Pixels in the FIFOs are colour indices. The palette is only looked up when
+// a pixel is shifted out to the LCD, so transparency and priority are decided
+// on the index and palette writes in the middle of a line take effect on the
+// next pixel.
+type fifoPixel struct {
+	colorIndex uint8
+	palette    uint8 // OBP0/OBP1 for sprites
+	bgPriority bool  // Sprite pixel is hidden behind background colours 1-3
+	source     PixelSource
+}
+
+// The background FIFO never holds more than 16 pixels (8 waiting to be shifted
+// out and one more tile), the sprite FIFO at most 8
+const PIXEL_FIFO_SIZE int = 16
+
+// pixelFifo is a fixed size ring buffer so shifting pixels never allocates
+type pixelFifo struct {
+	pixels [PIXEL_FIFO_SIZE]fifoPixel
+	head   int
+	length int
+}
+
+func (q *pixelFifo) Len() int {
+	return q.length
+}
+
+func (q *pixelFifo) Push(pixel fifoPixel) {
+	if q.length == PIXEL_FIFO_SIZE {
+		return
+	}
+	q.pixels[(q.head+q.length)%PIXEL_FIFO_SIZE] = pixel
+	q.length += 1
+}
+
+func (q *pixelFifo) Pop() fifoPixel {
+	pixel := q.pixels[q.head]
+	q.head = (q.head + 1) % PIXEL_FIFO_SIZE
+	q.length -= 1
+	return pixel
+}
+
+// At returns the i-th pixel from the front, which may be modified in place
+func (q *pixelFifo) At(i int) *fifoPixel {
+	return &q.pixels[(q.head+i)%PIXEL_FIFO_SIZE]
+}
+
+func (q *pixelFifo) Clear() {
+	q.head = 0
+	q.length = 0
+}
+
+func (q *pixelFifo) SaveState(w *StateWriter) {
+	w.WriteInt(q.length)
+	for i := 0; i < q.length; i++ {
+		writeFifoPixel(w, *q.At(i))
+	}
+}
+
+func (q *pixelFifo) LoadState(r *StateReader) {
+	q.Clear()
+	for i := r.ReadCount(PIXEL_FIFO_SIZE); i > 0; i-- {
+		q.Push(readFifoPixel(r))
+	}
+}
+
+func writeFifoPixel(w *StateWriter, pixel fifoPixel) {
+	w.WriteUint8(pixel.colorIndex)
+	w.WriteUint8(pixel.palette)
+	w.WriteBool(pixel.bgPriority)
+	w.WriteUint8(uint8(pixel.source))
+}
+
+func readFifoPixel(r *StateReader) fifoPixel {
+	return fifoPixel{
+		colorIndex: r.ReadUint8(),
+		palette:    r.ReadUint8(),
+		bgPriority: r.ReadBool(),
+		source:     PixelSource(r.ReadUint8()),
+	}
+}
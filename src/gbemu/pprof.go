@@ -0,0 +1,168 @@
+package gbemu
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// Minimal encoder for the pprof profile.proto format so profiles can be
+// opened with `go tool pprof` without pulling in the protobuf libraries.
+// See https://github.com/google/pprof/blob/main/proto/profile.proto
+
+const (
+	PROTO_WIRE_VARINT uint64 = 0
+	PROTO_WIRE_BYTES  uint64 = 2
+)
+
+type PprofSample struct {
+	LocationIDs []uint64 // Leaf first
+	Values      []int64
+}
+
+type PprofLocation struct {
+	ID         uint64
+	Address    uint64
+	FunctionID uint64
+}
+
+type PprofFunction struct {
+	ID   uint64
+	Name string
+}
+
+type PprofProfile struct {
+	SampleTypes [][2]string // Pairs of (type, unit)
+	Samples     []PprofSample
+	Locations   []PprofLocation
+	Functions   []PprofFunction
+	MappingName string
+	PeriodType  [2]string
+	Period      int64
+}
+
+type protoBuffer struct {
+	data []byte
+}
+
+type stringTable struct {
+	strings []string
+	indexes map[string]int64
+}
+
+func (p *PprofProfile) Write(w io.Writer) error {
+	strs := &stringTable{strings: []string{""}, indexes: map[string]int64{"": 0}}
+	profile := &protoBuffer{}
+
+	for _, sampleType := range p.SampleTypes {
+		profile.message(1, valueType(strs, sampleType))
+	}
+	for _, sample := range p.Samples {
+		s := &protoBuffer{}
+		s.packedUint64(1, sample.LocationIDs)
+		values := make([]uint64, len(sample.Values))
+		for i, v := range sample.Values {
+			values[i] = uint64(v)
+		}
+		s.packedUint64(2, values)
+		profile.message(2, s)
+	}
+
+	mapping := &protoBuffer{}
+	mapping.uint64Field(1, 1)
+	mapping.uint64Field(2, 0)
+	mapping.uint64Field(3, 0x1000000)
+	mapping.uint64Field(5, uint64(strs.index(p.MappingName)))
+	mapping.uint64Field(7, 1) // has_functions
+	profile.message(3, mapping)
+
+	for _, location := range p.Locations {
+		line := &protoBuffer{}
+		line.uint64Field(1, location.FunctionID)
+		l := &protoBuffer{}
+		l.uint64Field(1, location.ID)
+		l.uint64Field(2, 1)
+		l.uint64Field(3, location.Address)
+		l.message(4, line)
+		profile.message(4, l)
+	}
+	for _, function := range p.Functions {
+		f := &protoBuffer{}
+		f.uint64Field(1, function.ID)
+		f.uint64Field(2, uint64(strs.index(function.Name)))
+		f.uint64Field(3, uint64(strs.index(function.Name)))
+		profile.message(5, f)
+	}
+
+	// Every string has been interned by now so the period type has to be
+	// encoded before the table is written out
+	periodType := valueType(strs, p.PeriodType)
+	for _, s := range strs.strings {
+		profile.bytesField(6, []byte(s))
+	}
+	profile.message(11, periodType)
+	profile.uint64Field(12, uint64(p.Period))
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(profile.data); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func valueType(strs *stringTable, pair [2]string) *protoBuffer {
+	b := &protoBuffer{}
+	b.uint64Field(1, uint64(strs.index(pair[0])))
+	b.uint64Field(2, uint64(strs.index(pair[1])))
+	return b
+}
+
+func (t *stringTable) index(s string) int64 {
+	if idx, found := t.indexes[s]; found {
+		return idx
+	}
+	idx := int64(len(t.strings))
+	t.strings = append(t.strings, s)
+	t.indexes[s] = idx
+	return idx
+}
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.data = append(b.data, byte(x)|0x80)
+		x >>= 7
+	}
+	b.data = append(b.data, byte(x))
+}
+
+func (b *protoBuffer) key(field int, wireType uint64) {
+	b.varint(uint64(field)<<3 | wireType)
+}
+
+func (b *protoBuffer) uint64Field(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.key(field, PROTO_WIRE_VARINT)
+	b.varint(x)
+}
+
+func (b *protoBuffer) bytesField(field int, data []byte) {
+	b.key(field, PROTO_WIRE_BYTES)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+func (b *protoBuffer) message(field int, m *protoBuffer) {
+	b.bytesField(field, m.data)
+}
+
+func (b *protoBuffer) packedUint64(field int, values []uint64) {
+	if len(values) == 0 {
+		return
+	}
+	packed := &protoBuffer{}
+	for _, v := range values {
+		packed.varint(v)
+	}
+	b.bytesField(field, packed.data)
+}
@@ -1,68 +1,142 @@
-package main
+package gbemu
 
 type PPU interface {
 	Tick([]SpriteAttribute, int)
 	LineFinished() bool
 	Reset()
-	LcdBuffer(int, int) RGBPixel
+	Framebuffer() *Framebuffer
+	Snapshotter
 }
 
 type ppu struct {
-	fifo                      []RGBPixel
-	fetcher                   Fetcher
-	lcdBuffer                 [][]RGBPixel
-	currentFetchPixel         uint16
-	lcdCurrentPixel           uint16
-	currentSpritePixelFetched bool
-	fetchingSprite            bool
-	mmu                       MMU
-	lastFetchedSprite         SpriteAttribute
+	fifo              pixelFifo
+	spriteFifo        pixelFifo // Lines up with the first pixels of fifo
+	fetcher           Fetcher
+	spriteFetcher     Fetcher
+	lcdBuffer         *Framebuffer
+	currentFetchPixel uint16
+	lcdCurrentPixel   uint16
+	spritesFetched    uint16 // Bit per visible sprite that has been fetched on this line
+	fetchingSprite    bool
+	pendingSprite     SpriteAttribute // Waiting for the background fetch to finish
+	mmu               MMU
+	lastFetchedSprite SpriteAttribute
+	lineStarting      bool
+	discardFetch      bool  // The first tile fetched on a line is thrown away
+	scrollDiscard     uint8 // Pixels left to drop for the fine SCX scroll or a window left of the screen
+	windowTriggered   bool  // WY matched LY at some point this frame
+	windowActive      bool  // The window is being drawn on this line
+	windowLine        uint8 // Internal window line counter
+	windowFetchPixel  uint16
+	windowNextLine    bool // WX=166 quirk, see startWindowIfReached
 }
 
 func createPPU(mmu MMU) PPU {
-	buffer := make([][]RGBPixel, SCREEN_HEIGHT)
-	for i := range buffer {
-		buffer[i] = make([]RGBPixel, SCREEN_WIDTH)
-	}
-
 	return &ppu{
-		fifo:                      make([]RGBPixel, 0),
-		fetcher:                   createFetcher(mmu),
-		currentFetchPixel:         0,
-		lcdCurrentPixel:           0,
-		currentSpritePixelFetched: false,
-		lcdBuffer:                 buffer,
-		fetchingSprite:            false,
-		mmu:                       mmu,
+		fetcher:           createFetcher(mmu),
+		spriteFetcher:     createFetcher(mmu),
+		currentFetchPixel: 0,
+		lcdCurrentPixel:   0,
+		spritesFetched:    0,
+		lcdBuffer:         &Framebuffer{},
+		fetchingSprite:    false,
+		mmu:               mmu,
+		lineStarting:      true,
 	}
 }
 
 func (p *ppu) Tick(sprites []SpriteAttribute, currentLine int) {
-	// Shifts in 8 pixels at a time from the fetcher, if they are available
-	if pixels := p.fetcher.Fetch(currentLine); pixels != nil {
-		if p.fetchingSprite {
-			p.currentSpritePixelFetched = true
-			p.overlayPixels(pixels)
+	if p.lineStarting {
+		p.startLine(currentLine)
+	}
+
+	if p.pendingSprite == nil && !p.fetchingSprite && p.canShiftOut() {
+		p.shiftOutPixel(currentLine, sprites)
+	}
+
+	// The background fetcher and the LCD are stopped while a sprite is fetched
+	if p.fetchingSprite {
+		if p.spriteFetcher.Fetch(currentLine) {
+			p.overlayPixels(p.spriteFetcher.Pixels())
 			p.fetchingSprite = false
-			p.fetcher.Reset(p.currentFetchPixel, BG_FETCH, nil)
+		}
+		return
+	}
+
+	// Shifts in 8 pixels at a time from the fetcher once they are available
+	// and the FIFO has run empty
+	fetched := p.fetcher.Fetch(currentLine)
+	if fetched && p.fifo.Len() == 0 {
+		if p.discardFetch {
+			p.discardFetch = false
 		} else {
-			p.shiftInPixels(pixels, currentLine)
-			p.fetcher.Reset(p.currentFetchPixel, BG_FETCH, nil)
+			p.shiftInPixels(p.fetcher.Pixels(), currentLine)
 		}
+		p.resumeFetch()
+		fetched = false
 	}
 
-	if p.canShiftOut() {
-		p.shiftOutPixel(currentLine, sprites)
+	// A sprite fetch waits until the current background fetch is done and
+	// the FIFO has pixels, which is where most of the sprite penalty comes from
+	if p.pendingSprite != nil && fetched && p.fifo.Len() > 0 {
+		p.lastFetchedSprite = p.pendingSprite
+		p.pendingSprite = nil
+		p.fetchingSprite = true
+		p.spriteFetcher.Reset(p.lcdCurrentPixel, SPRITE_FETCH, p.lastFetchedSprite)
+		p.spriteFetcher.Fetch(currentLine)
+	}
+}
+
+func (p *ppu) startLine(currentLine int) {
+	p.lineStarting = false
+	p.discardFetch = true
+	p.spritesFetched = 0
+	p.scrollDiscard = p.mmu.ScrollX() & 0x07
+	if currentLine == 0 {
+		p.windowTriggered = false
+		p.windowLine = 0
+	}
+	// WY is only compared at the start of each line, once it has matched the
+	// window stays triggered for the rest of the frame
+	if currentLine == int(p.mmu.WindowYPosition()) {
+		p.windowTriggered = true
+	}
+	if p.windowNextLine {
+		p.windowNextLine = false
+		if p.windowEnabled() {
+			p.scrollDiscard = 0
+			p.startWindow()
+		}
+	}
+}
+
+// resumeFetch restarts the fetcher on the next background or window tile
+func (p *ppu) resumeFetch() {
+	if p.windowActive {
+		p.fetcher.Reset(p.windowFetchPixel, WINDOW_FETCH, nil)
+	} else {
+		p.fetcher.Reset(p.currentFetchPixel, BG_FETCH, nil)
 	}
 }
 
 func (p *ppu) Reset() {
+	if p.windowActive {
+		p.windowLine += 1
+		p.windowActive = false
+	}
 	p.currentFetchPixel = 0
 	p.lcdCurrentPixel = 0
+	p.lineStarting = true
+	// Pixels fetched past the end of the line are thrown away
+	p.fifo.Clear()
+	p.spriteFifo.Clear()
+	p.fetchingSprite = false
+	p.pendingSprite = nil
+	p.fetcher.Reset(0, BG_FETCH, nil)
 }
 
 func (p *ppu) canShiftOut() bool {
-	return len(p.fifo) > 8 && p.lcdCurrentPixel < uint16(SCREEN_WIDTH) && !p.fetchingSprite
+	return p.fifo.Len() > 0 && p.lcdCurrentPixel < uint16(SCREEN_WIDTH)
 }
 
 func (p *ppu) LineFinished() bool {
@@ -70,76 +144,201 @@ func (p *ppu) LineFinished() bool {
 }
 
 func (p *ppu) shiftOutPixel(currentLine int, sprites []SpriteAttribute) {
-	if p.isUnfetchedSpritePixel(sprites) {
+	if p.startWindowIfReached() {
+		return
+	} else if p.scrollDiscard > 0 {
+		// The first SCX & 7 pixels of the first tile are fetched but never shown
+		p.fifo.Pop()
+		p.scrollDiscard -= 1
+	} else if p.isUnfetchedSpritePixel(sprites) {
 		return
-	} else if p.isUnfetchedWindowPixel(currentLine) {
-		// When starting a window fetch clear the entire FIFO and start refetching for window pixels
-		p.fifo = make([]RGBPixel, 0)
-		p.fetcher.Reset(uint16(p.lcdCurrentPixel), WINDOW_FETCH, nil)
 	} else {
-		if !p.mmu.BGDisplayEnabled() {
-			p.lcdBuffer[currentLine][p.lcdCurrentPixel] = WHITE() // When background is not enabled we should only draw blank pixels
-		} else {
-			p.lcdBuffer[currentLine][p.lcdCurrentPixel] = p.fifo[0]
-		}
-		p.fifo = p.fifo[1:]
+		p.lcdBuffer[currentLine][p.lcdCurrentPixel] = p.mixPixel()
 		p.lcdCurrentPixel += 1
-		p.currentSpritePixelFetched = false
 	}
 }
 
+// mixPixel shifts out the pixels at the front of the FIFOs and picks the
+// background or sprite one. Sprite colour 0 is transparent and sprites with
+// the BG priority flag are only drawn over background colour 0. Only the
+// chosen pixel goes through its palette.
+func (p *ppu) mixPixel() RGBPixel {
+	bg := p.fifo.Pop()
+	if !p.mmu.BGDisplayEnabled() {
+		// The background and window are blank, sprites are still drawn
+		bg.colorIndex = 0
+	}
+	if p.spriteFifo.Len() > 0 {
+		sprite := p.spriteFifo.Pop()
+		if sprite.colorIndex != 0 && !(sprite.bgPriority && bg.colorIndex != 0) {
+			return p.mmu.ConvertNumToSpritePixel(int(sprite.colorIndex), int(sprite.palette))
+		}
+	}
+	if !p.mmu.BGDisplayEnabled() {
+		return WHITE()
+	}
+	return p.mmu.ConvertNumToBgPixel(int(bg.colorIndex))
+}
+
+// isUnfetchedSpritePixel queues a fetch for the next sprite that begins at the
+// current X position. Sprites are sorted by X and then OAM index, which is
+// also their priority, so they are fetched in priority order. Sprites with an
+// X below 8 are partially off screen and are all fetched at X 0.
 func (p *ppu) isUnfetchedSpritePixel(sprites []SpriteAttribute) bool {
-	for _, sprite := range sprites {
-		if sprite != nil && sprite.GetXPosition() > 0 && sprite.GetXPosition()-8 == int(p.lcdCurrentPixel) && !p.currentSpritePixelFetched && p.mmu.SpritesEnabled() {
-			p.fetcher.Reset(uint16(p.lcdCurrentPixel), SPRITE_FETCH, sprite)
-			p.currentFetchPixel = p.lcdCurrentPixel
-			p.fetchingSprite = true
-			p.lastFetchedSprite = sprite
+	if !p.mmu.SpritesEnabled() {
+		return false
+	}
+	for i, sprite := range sprites {
+		if sprite == nil || p.spritesFetched&(1<<uint(i)) != 0 {
+			continue
+		}
+		// Sprites at X 0 are fetched even though none of their pixels show
+		x := sprite.GetXPosition()
+		if x >= SCREEN_WIDTH+8 {
+			continue
+		}
+		if x-8 == int(p.lcdCurrentPixel) || (x < 8 && p.lcdCurrentPixel == 0) {
+			p.spritesFetched |= 1 << uint(i)
+			p.pendingSprite = sprite
 			return true
-			// 1. Stop current fetching
-			// 2. Start fetching sprite pixels
-			// 3. Overlay first 8 pixels from background with sprite pixels
-			// 4. Resume fetching background
 		}
 	}
 	return false
 }
 
-func (p *ppu) isUnfetchedWindowPixel(currentLine int) bool {
-	if currentLine >= int(p.mmu.WindowYPosition()) && p.mmu.WindowDisplayEnabled() {
-		return true
+func (p *ppu) windowEnabled() bool {
+	return p.windowTriggered && p.mmu.WindowDisplayEnabled() && p.mmu.BGDisplayEnabled()
+}
+
+// The window starts once the X position reaches WX - 7. WX below 7 puts the
+// window partly off the left edge, so it starts at X 0 with the hidden pixels
+// dropped. Two values behave oddly on the DMG:
+//
+//	WX=0   - the window is triggered before the fine SCX pixels have been
+//	         dropped, so those are dropped from the window as well and it
+//	         moves with SCX & 7
+//	WX=166 - the window starts on the last pixel and then covers the whole
+//	         next line
+func (p *ppu) startWindowIfReached() bool {
+	if p.windowActive || !p.windowEnabled() {
+		return false
+	}
+
+	wx := p.mmu.WindowXPosition()
+	if wx == 0 && p.lcdCurrentPixel == 0 {
+		p.scrollDiscard += 7
+	} else if wx < 7 && p.lcdCurrentPixel == 0 && p.scrollDiscard == 0 {
+		p.scrollDiscard = 7 - wx
+	} else if wx >= 7 && int(p.lcdCurrentPixel) == int(wx)-7 && p.scrollDiscard == 0 {
+		p.windowNextLine = wx == 166
 	} else {
 		return false
 	}
+	p.startWindow()
+	return true
 }
 
-func (p *ppu) shiftInPixels(pixels []RGBPixel, currentLine int) {
+// startWindow throws away the background pixels and fetches the window from
+// its first tile instead
+func (p *ppu) startWindow() {
+	p.windowActive = true
+	p.windowFetchPixel = 0
+	p.fifo.Clear()
+	p.fetcher.SetWindowLine(p.windowLine)
+	p.fetcher.Reset(0, WINDOW_FETCH, nil)
+}
+
+func (p *ppu) shiftInPixels(pixels *[8]fifoPixel, currentLine int) {
 	for _, pixel := range pixels {
-		p.fifo = append(p.fifo, pixel)
+		p.fifo.Push(pixel)
+	}
+	if p.windowActive {
+		p.windowFetchPixel += uint16(len(pixels))
+	} else {
+		p.currentFetchPixel += uint16(len(pixels))
 	}
-	p.currentFetchPixel += uint16(len(pixels))
 }
 
-func (p *ppu) LcdBuffer(y, x int) RGBPixel {
-	return p.lcdBuffer[y][x]
+func (p *ppu) Framebuffer() *Framebuffer {
+	return p.lcdBuffer
 }
 
-func (p *ppu) overlayPixels(pixels []RGBPixel) {
-	for idx, pixel := range pixels {
-		if p.lastFetchedSprite.HasPriority() {
-			p.fifo[idx] = p.combineColors(pixel, p.fifo[idx], true)
-		} else {
-			p.fifo[idx] = p.combineColors(pixel, p.fifo[idx], false)
+// overlayPixels merges a fetched sprite into the sprite FIFO. Pixels already
+// in the FIFO belong to sprites with a higher priority, so the new sprite only
+// fills in where they are transparent.
+func (p *ppu) overlayPixels(pixels *[8]fifoPixel) {
+	visible := pixels[:]
+	if x := p.lastFetchedSprite.GetXPosition(); x < 8 {
+		visible = pixels[8-x:]
+	}
+	for p.spriteFifo.Len() < len(visible) {
+		p.spriteFifo.Push(fifoPixel{source: SOURCE_SPRITE})
+	}
+	for idx, pixel := range visible {
+		if current := p.spriteFifo.At(idx); current.colorIndex == 0 {
+			*current = pixel
 		}
 	}
-	p.currentFetchPixel += uint16(len(pixels))
 }
 
-func (p *ppu) combineColors(spritePixel, bgPixel RGBPixel, spriteHasPriority bool) RGBPixel {
-	// TODO: This might want to check against the value of color 0 rather then WHITE
-	if spriteHasPriority || bgPixel == WHITE() {
-		return spritePixel
-	} else {
-		return bgPixel
+func (p *ppu) SaveState(w *StateWriter) {
+	for y := range p.lcdBuffer {
+		for _, pixel := range p.lcdBuffer[y] {
+			writePixel(w, pixel)
+		}
+	}
+	p.fifo.SaveState(w)
+	p.spriteFifo.SaveState(w)
+	w.WriteUint16(p.currentFetchPixel)
+	w.WriteUint16(p.lcdCurrentPixel)
+	w.WriteUint16(p.spritesFetched)
+	w.WriteBool(p.fetchingSprite)
+	writeSpriteAttribute(w, p.pendingSprite)
+	writeSpriteAttribute(w, p.lastFetchedSprite)
+	w.WriteBool(p.lineStarting)
+	w.WriteBool(p.discardFetch)
+	w.WriteUint8(p.scrollDiscard)
+	w.WriteBool(p.windowTriggered)
+	w.WriteBool(p.windowActive)
+	w.WriteUint8(p.windowLine)
+	w.WriteUint16(p.windowFetchPixel)
+	w.WriteBool(p.windowNextLine)
+	p.fetcher.SaveState(w)
+	p.spriteFetcher.SaveState(w)
+}
+
+func (p *ppu) LoadState(r *StateReader) {
+	for y := range p.lcdBuffer {
+		for x := range p.lcdBuffer[y] {
+			p.lcdBuffer[y][x] = readPixel(r)
+		}
 	}
+	p.fifo.LoadState(r)
+	p.spriteFifo.LoadState(r)
+	p.currentFetchPixel = r.ReadUint16()
+	p.lcdCurrentPixel = r.ReadUint16()
+	p.spritesFetched = r.ReadUint16()
+	p.fetchingSprite = r.ReadBool()
+	p.pendingSprite = readSpriteAttribute(r)
+	p.lastFetchedSprite = readSpriteAttribute(r)
+	p.lineStarting = r.ReadBool()
+	p.discardFetch = r.ReadBool()
+	p.scrollDiscard = r.ReadUint8()
+	p.windowTriggered = r.ReadBool()
+	p.windowActive = r.ReadBool()
+	p.windowLine = r.ReadUint8()
+	p.windowFetchPixel = r.ReadUint16()
+	p.windowNextLine = r.ReadBool()
+	p.fetcher.LoadState(r)
+	p.spriteFetcher.LoadState(r)
+}
+
+func writePixel(w *StateWriter, pixel RGBPixel) {
+	w.WriteUint8(pixel.Red)
+	w.WriteUint8(pixel.Green)
+	w.WriteUint8(pixel.Blue)
+}
+
+func readPixel(r *StateReader) RGBPixel {
+	return RGBPixel{Red: r.ReadUint8(), Green: r.ReadUint8(), Blue: r.ReadUint8()}
 }
@@ -0,0 +1,275 @@
+package gbemu
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// The profiler attributes the cycles of every executed instruction to its PC
+// and, using the shadow call stack, to the function it was executed in (self)
+// and to every function on the stack (inclusive). The cycles from a HALT until
+// the interrupt that wakes the CPU are kept separately so idle time doesn't
+// drown out the functions that actually do work.
+
+const PROFILE_ROOT_FUNCTION string = "(root)"
+const PROFILE_HALT_FUNCTION string = "(halt)"
+
+type Profiler interface {
+	Record(uint16, int, int, bool, []StackFrame)
+	WriteReport(io.Writer)
+	WriteProfile(io.Writer) error
+}
+
+type profileCounter struct {
+	instructions uint64
+	cycles       uint64
+}
+
+type profileFunction struct {
+	bank    int
+	address uint16
+	root    bool
+}
+
+type profileStack struct {
+	locations []profileLocation // Leaf first
+	counter   profileCounter
+}
+
+type profileLocation struct {
+	address  uint32 // bank << 16 | address
+	function profileFunction
+	halt     bool
+}
+
+type profiler struct {
+	symbols   SymbolTable
+	romName   string
+	addresses map[uint32]*profileCounter
+	self      map[profileFunction]*profileCounter
+	inclusive map[profileFunction]*profileCounter
+	stacks    map[string]*profileStack
+	halt      profileCounter
+	total     profileCounter
+	seen      []profileFunction
+	keyBuffer []byte
+	lock      sync.Mutex
+}
+
+func CreateProfiler(symbols SymbolTable, romName string) Profiler {
+	return &profiler{
+		symbols:   symbols,
+		romName:   romName,
+		addresses: make(map[uint32]*profileCounter),
+		self:      make(map[profileFunction]*profileCounter),
+		inclusive: make(map[profileFunction]*profileCounter),
+		stacks:    make(map[string]*profileStack),
+	}
+}
+
+// Record attributes one executed instruction. frames is the live call stack,
+// outermost first.
+func (p *profiler) Record(pc uint16, bank int, cycles int, halted bool, frames []StackFrame) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.total.add(cycles)
+	address := uint32(bank)<<16 | uint32(pc)
+	counter, found := p.addresses[address]
+	if !found {
+		counter = &profileCounter{}
+		p.addresses[address] = counter
+	}
+	counter.add(cycles)
+
+	current := profileFunction{root: true}
+	if len(frames) > 0 {
+		innermost := frames[len(frames)-1]
+		current = profileFunction{bank: innermost.Bank, address: innermost.Target}
+	}
+	if halted {
+		p.halt.add(cycles)
+	} else {
+		functionCounter(p.self, current).add(cycles)
+	}
+
+	// Recursive functions only count once towards their inclusive time
+	p.seen = append(p.seen[:0], profileFunction{root: true})
+	for _, frame := range frames {
+		p.seen = appendUnique(p.seen, profileFunction{bank: frame.Bank, address: frame.Target})
+	}
+	for _, function := range p.seen {
+		functionCounter(p.inclusive, function).add(cycles)
+	}
+
+	p.recordStack(address, current, halted, frames, cycles)
+}
+
+func (p *profiler) recordStack(address uint32, current profileFunction, halted bool, frames []StackFrame, cycles int) {
+	p.keyBuffer = appendStackKey(p.keyBuffer[:0], address)
+	if halted {
+		p.keyBuffer = append(p.keyBuffer, 1)
+	}
+	for i := len(frames) - 1; i >= 0; i-- {
+		p.keyBuffer = appendStackKey(p.keyBuffer, uint32(frames[i].Bank)<<16|uint32(frames[i].CallSite))
+	}
+
+	stack, found := p.stacks[string(p.keyBuffer)]
+	if !found {
+		stack = &profileStack{}
+		if halted {
+			stack.locations = append(stack.locations, profileLocation{address: address, halt: true})
+		}
+		stack.locations = append(stack.locations, profileLocation{address: address, function: current})
+		for i := len(frames) - 1; i >= 0; i-- {
+			caller := profileFunction{root: true}
+			if i > 0 {
+				caller = profileFunction{bank: frames[i-1].Bank, address: frames[i-1].Target}
+			}
+			callSite := uint32(frames[i].Bank)<<16 | uint32(frames[i].CallSite)
+			stack.locations = append(stack.locations, profileLocation{address: callSite, function: caller})
+		}
+		p.stacks[string(p.keyBuffer)] = stack
+	}
+	stack.counter.add(cycles)
+}
+
+func (p *profiler) WriteReport(w io.Writer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	fmt.Fprintf(w, "Total: %d cycles, %d instructions\n", p.total.cycles, p.total.instructions)
+	fmt.Fprintf(w, "HALT:  %d cycles (%.2f%%)\n\n", p.halt.cycles, p.percent(p.halt.cycles))
+
+	fmt.Fprintln(w, "Functions:")
+	fmt.Fprintf(w, "%12s %7s %12s %7s  %s\n", "self", "self%", "inclusive", "incl%", "function")
+	functions := make([]profileFunction, 0, len(p.inclusive))
+	for function := range p.inclusive {
+		functions = append(functions, function)
+	}
+	sort.Slice(functions, func(i, j int) bool {
+		return p.selfCycles(functions[i]) > p.selfCycles(functions[j])
+	})
+	for _, function := range functions {
+		self, inclusive := p.selfCycles(function), p.inclusive[function].cycles
+		fmt.Fprintf(w, "%12d %6.2f%% %12d %6.2f%%  %s\n", self, p.percent(self), inclusive, p.percent(inclusive), p.functionName(function))
+	}
+
+	fmt.Fprintln(w, "\nAddresses:")
+	fmt.Fprintf(w, "%12s %7s %12s  %s\n", "cycles", "%", "executed", "address")
+	addresses := make([]uint32, 0, len(p.addresses))
+	for address := range p.addresses {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return p.addresses[addresses[i]].cycles > p.addresses[addresses[j]].cycles
+	})
+	for _, address := range addresses {
+		counter := p.addresses[address]
+		fmt.Fprintf(w, "%12d %6.2f%% %12d  %s\n", counter.cycles, p.percent(counter.cycles), counter.instructions, p.addressName(address))
+	}
+}
+
+func (p *profiler) WriteProfile(w io.Writer) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	profile := &PprofProfile{
+		SampleTypes: [][2]string{{"instructions", "count"}, {"cycles", "count"}},
+		MappingName: p.romName,
+		PeriodType:  [2]string{"cycles", "count"},
+		Period:      1,
+	}
+
+	functionIDs := make(map[string]uint64)
+	locationIDs := make(map[profileLocation]uint64)
+	for _, stack := range p.stacks {
+		sample := PprofSample{Values: []int64{int64(stack.counter.instructions), int64(stack.counter.cycles)}}
+		for _, location := range stack.locations {
+			id, found := locationIDs[location]
+			if !found {
+				name := p.functionName(location.function)
+				if location.halt {
+					name = PROFILE_HALT_FUNCTION
+				}
+				functionID, found := functionIDs[name]
+				if !found {
+					functionID = uint64(len(functionIDs) + 1)
+					functionIDs[name] = functionID
+					profile.Functions = append(profile.Functions, PprofFunction{ID: functionID, Name: name})
+				}
+				id = uint64(len(locationIDs) + 1)
+				locationIDs[location] = id
+				profile.Locations = append(profile.Locations, PprofLocation{ID: id, Address: uint64(location.address), FunctionID: functionID})
+			}
+			sample.LocationIDs = append(sample.LocationIDs, id)
+		}
+		profile.Samples = append(profile.Samples, sample)
+	}
+
+	return profile.Write(w)
+}
+
+func (p *profiler) selfCycles(function profileFunction) uint64 {
+	if counter, found := p.self[function]; found {
+		return counter.cycles
+	}
+	return 0
+}
+
+func (p *profiler) percent(cycles uint64) float64 {
+	if p.total.cycles == 0 {
+		return 0
+	}
+	return float64(cycles) * 100 / float64(p.total.cycles)
+}
+
+func (p *profiler) functionName(function profileFunction) string {
+	if function.root {
+		return PROFILE_ROOT_FUNCTION
+	}
+	if label, found := p.symbols.Lookup(function.bank, function.address); found {
+		return label
+	}
+	if name, found := interruptVectorNames[function.address]; found {
+		return fmt.Sprintf("%s interrupt", name)
+	}
+	return fmt.Sprintf("func_%02X_%04X", function.bank, function.address)
+}
+
+func (p *profiler) addressName(address uint32) string {
+	bank, pc := int(address>>16), uint16(address)
+	if label := p.symbols.Symbolize(bank, pc); label != "" {
+		return fmt.Sprintf("%02X:%04X %s", bank, pc, label)
+	}
+	return fmt.Sprintf("%02X:%04X", bank, pc)
+}
+
+func (c *profileCounter) add(cycles int) {
+	c.instructions += 1
+	c.cycles += uint64(cycles)
+}
+
+func functionCounter(counters map[profileFunction]*profileCounter, function profileFunction) *profileCounter {
+	counter, found := counters[function]
+	if !found {
+		counter = &profileCounter{}
+		counters[function] = counter
+	}
+	return counter
+}
+
+func appendStackKey(key []byte, address uint32) []byte {
+	return append(key, byte(address), byte(address>>8), byte(address>>16))
+}
+
+func appendUnique(functions []profileFunction, function profileFunction) []profileFunction {
+	for _, f := range functions {
+		if f == function {
+			return functions
+		}
+	}
+	return append(functions, function)
+}
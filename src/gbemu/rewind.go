@@ -0,0 +1,168 @@
+package gbemu
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The rewind buffer keeps the newest snapshot in full and every older one as
+// a reverse delta: the XOR against the snapshot taken after it, with runs of
+// zero bytes (memory that didn't change) skipped. Going back a step applies
+// the newest delta to the full snapshot, and when the memory budget is
+// exceeded the oldest deltas can simply be dropped since nothing depends on
+// them.
+//
+// Delta encoding:
+//	uvarint length of the older snapshot
+//	repeated: uvarint count of unchanged bytes, uvarint count of changed
+//	          bytes, followed by that many XORed bytes
+
+type RewindBuffer interface {
+	Capture([]byte)
+	Rewind() ([]byte, bool)
+	Len() int
+	Size() int
+}
+
+type rewindBuffer struct {
+	current []byte   // Newest snapshot
+	spare   []byte   // Reused when the next snapshot replaces current
+	deltas  [][]byte // Oldest first
+	scratch []byte
+	size    int // Bytes used by current and deltas
+	budget  int
+}
+
+func CreateRewindBuffer(budget int) RewindBuffer {
+	return &rewindBuffer{budget: budget}
+}
+
+// Capture records a new snapshot. The data is copied.
+func (b *rewindBuffer) Capture(snapshot []byte) {
+	if b.current != nil {
+		delta := b.encodeDelta(snapshot, b.current)
+		b.deltas = append(b.deltas, delta)
+		b.size += len(delta)
+	}
+
+	b.size -= len(b.current)
+	b.spare = append(b.spare[:0], snapshot...)
+	b.current, b.spare = b.spare, b.current
+	b.size += len(b.current)
+
+	for b.size > b.budget && len(b.deltas) > 0 {
+		b.size -= len(b.deltas[0])
+		b.deltas[0] = nil
+		b.deltas = b.deltas[1:]
+	}
+}
+
+// Rewind returns the newest snapshot and steps the buffer back one, so the
+// next call returns the one before it. The returned slice is only valid until
+// the next call.
+func (b *rewindBuffer) Rewind() ([]byte, bool) {
+	if b.current == nil {
+		return nil, false
+	}
+
+	b.spare = append(b.spare[:0], b.current...)
+	if len(b.deltas) == 0 {
+		// Oldest snapshot, keep returning it
+		return b.spare, true
+	}
+
+	last := len(b.deltas) - 1
+	previous, err := b.applyDelta(b.current, b.deltas[last])
+	if err != nil {
+		fmt.Println(err)
+		b.deltas = nil
+		return b.spare, true
+	}
+	b.size += len(previous) - len(b.current) - len(b.deltas[last])
+	b.current = previous
+	b.deltas[last] = nil
+	b.deltas = b.deltas[:last]
+	return b.spare, true
+}
+
+// Len is the number of snapshots that can be rewound to
+func (b *rewindBuffer) Len() int {
+	if b.current == nil {
+		return 0
+	}
+	return len(b.deltas) + 1
+}
+
+func (b *rewindBuffer) Size() int {
+	return b.size
+}
+
+// encodeDelta encodes older relative to newer. Bytes past the end of either
+// snapshot are treated as 0.
+func (b *rewindBuffer) encodeDelta(newer, older []byte) []byte {
+	b.scratch = appendUvarint(b.scratch[:0], uint64(len(older)))
+	i := 0
+	for i < len(older) {
+		start := i
+		for i < len(older) && older[i] == byteAt(newer, i) {
+			i++
+		}
+		unchanged := i - start
+
+		start = i
+		for i < len(older) && older[i] != byteAt(newer, i) {
+			i++
+		}
+		b.scratch = appendUvarint(b.scratch, uint64(unchanged))
+		b.scratch = appendUvarint(b.scratch, uint64(i-start))
+		for j := start; j < i; j++ {
+			b.scratch = append(b.scratch, older[j]^byteAt(newer, j))
+		}
+	}
+	return append([]byte(nil), b.scratch...)
+}
+
+func (b *rewindBuffer) applyDelta(newer, delta []byte) ([]byte, error) {
+	length, n := binary.Uvarint(delta)
+	if n <= 0 {
+		return nil, fmt.Errorf("ERROR corrupt rewind delta")
+	}
+	delta = delta[n:]
+
+	older := make([]byte, length)
+	copy(older, newer)
+	i := 0
+	for len(delta) > 0 {
+		unchanged, n := binary.Uvarint(delta)
+		if n <= 0 {
+			return nil, fmt.Errorf("ERROR corrupt rewind delta")
+		}
+		delta = delta[n:]
+		changed, n := binary.Uvarint(delta)
+		if n <= 0 || uint64(len(delta)-n) < changed || uint64(i)+unchanged+changed > length {
+			return nil, fmt.Errorf("ERROR corrupt rewind delta")
+		}
+		delta = delta[n:]
+
+		i += int(unchanged)
+		for j := 0; j < int(changed); j++ {
+			older[i] = byteAt(newer, i) ^ delta[j]
+			i++
+		}
+		delta = delta[changed:]
+	}
+	return older, nil
+}
+
+func byteAt(data []byte, i int) byte {
+	if i < len(data) {
+		return data[i]
+	}
+	return 0
+}
+
+func appendUvarint(data []byte, x uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], x)
+	return append(data, b[:n]...)
+}
@@ -0,0 +1,127 @@
+package gbemu
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRewindDeltaRoundTrip(t *testing.T) {
+	base := make([]byte, 64)
+	for i := range base {
+		base[i] = uint8(i)
+	}
+	modified := func(change func([]byte) []byte) []byte {
+		return change(append([]byte(nil), base...))
+	}
+
+	tests := []struct {
+		name  string
+		older []byte
+		newer []byte
+	}{
+		{"unchanged", base, base},
+		{"one byte", base, modified(func(b []byte) []byte { b[10] = 0xFF; return b })},
+		{"first and last byte", base, modified(func(b []byte) []byte { b[0], b[63] = 0xAA, 0xBB; return b })},
+		{"several runs", base, modified(func(b []byte) []byte { b[3], b[4], b[20], b[40] = 0, 0, 0, 0; return b })},
+		{"newer is longer", base, modified(func(b []byte) []byte { return append(b, 1, 2, 3) })},
+		{"newer is shorter", base, modified(func(b []byte) []byte { return b[:32] })},
+		{"empty older", []byte{}, base},
+		{"empty newer", base, []byte{}},
+	}
+
+	for _, test := range tests {
+		b := &rewindBuffer{}
+		delta := b.encodeDelta(test.newer, test.older)
+		got, err := b.applyDelta(test.newer, delta)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if !bytes.Equal(got, test.older) {
+			t.Errorf("%s: applying the delta gave % X, want % X", test.name, got, test.older)
+		}
+	}
+}
+
+func TestRewindDeltaCorrupt(t *testing.T) {
+	b := &rewindBuffer{}
+	newer := []byte{1, 2, 3, 4}
+	tests := []struct {
+		name  string
+		delta []byte
+	}{
+		{"empty", []byte{}},
+		{"truncated run", []byte{4, 0}},
+		{"missing changed bytes", []byte{4, 0, 3, 0xFF}},
+		{"past the end", []byte{4, 3, 2, 0xFF, 0xFF}},
+	}
+
+	for _, test := range tests {
+		if _, err := b.applyDelta(newer, test.delta); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestRewindBuffer(t *testing.T) {
+	snapshots := [][]byte{{0, 0, 0, 0}, {1, 0, 0, 0}, {1, 2, 0, 0}, {1, 2, 3, 0, 5}}
+	b := CreateRewindBuffer(1 << 20)
+	for _, snapshot := range snapshots {
+		b.Capture(snapshot)
+	}
+	if b.Len() != len(snapshots) {
+		t.Fatalf("Len() = %d, want %d", b.Len(), len(snapshots))
+	}
+
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		got, ok := b.Rewind()
+		if !ok || !bytes.Equal(got, snapshots[i]) {
+			t.Errorf("Rewind() = % X, %v, want % X", got, ok, snapshots[i])
+		}
+	}
+	// The oldest snapshot is kept
+	if got, ok := b.Rewind(); !ok || !bytes.Equal(got, snapshots[0]) {
+		t.Errorf("Rewind() past the oldest snapshot = % X, %v, want % X", got, ok, snapshots[0])
+	}
+}
+
+func TestRewindBufferBudget(t *testing.T) {
+	b := CreateRewindBuffer(64)
+	for i := 0; i < 16; i++ {
+		snapshot := make([]byte, 32)
+		snapshot[i] = 0xFF
+		b.Capture(snapshot)
+	}
+	if b.Size() > 64 {
+		t.Errorf("Size() = %d, want at most the 64 byte budget", b.Size())
+	}
+	if b.Len() < 2 || b.Len() >= 16 {
+		t.Errorf("Len() = %d after going over budget, want old snapshots dropped", b.Len())
+	}
+
+	got, _ := b.Rewind()
+	if got[15] != 0xFF {
+		t.Errorf("newest snapshot lost after dropping old ones")
+	}
+}
+
+func TestEmulatorRewind(t *testing.T) {
+	emulator, err := New(testROM("TEST"), Options{RewindBudget: 1 << 20, RewindInterval: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var states []RegisterState
+	for i := 0; i < 5; i++ {
+		emulator.RunFrame()
+		states = append(states, emulator.Registers())
+	}
+
+	for i := len(states) - 1; i >= 0; i-- {
+		if !emulator.Rewind() {
+			t.Fatalf("Rewind() failed with %d snapshots left", i+1)
+		}
+		if got := emulator.Registers(); got != states[i] {
+			t.Errorf("registers after rewinding to frame %d = %+v, want %+v", i, got, states[i])
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package gbemu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// Save state file format, all integers little endian:
+//
+//	Header (48 bytes)
+//	  0  [8]byte  magic "GBEMUSAV"
+//	  8  uint16   format version (SAVE_STATE_VERSION)
+//	 10  uint16   reserved, 0
+//	 12  [16]byte ROM title from the cartridge header (0x0134 - 0x0143)
+//	 28  uint16   ROM global checksum from the cartridge header (0x014E - 0x014F)
+//	 30  uint16   reserved, 0
+//	 32  uint32   CRC-32 of the whole ROM
+//	 36  uint32   payload length in bytes
+//	 40  uint32   CRC-32 of the payload
+//	 44  uint32   reserved, 0
+//	Payload
+//	  A sequence of sections, each a 4 byte tag, a uint32 length and the
+//	  section data. Sections are written in the order CPU_, MMU_, TIMR, LCD_
+//	  and every section has to be present. MAPR is reserved for the mapper
+//	  state once cartridges with memory bank controllers are supported.
+//
+// Any change to what a component saves has to bump SAVE_STATE_VERSION.
+// States are only loaded into the exact ROM (by CRC) they were saved from.
+const (
+	SAVE_STATE_MAGIC       string = "GBEMUSAV"
+	SAVE_STATE_VERSION     uint16 = 13
+	SAVE_STATE_HEADER_SIZE int    = 48
+)
+
+type saveStateHeader struct {
+	Magic          [8]byte
+	Version        uint16
+	_              uint16
+	Title          [16]byte
+	GlobalChecksum uint16
+	_              uint16
+	ROMChecksum    uint32
+	PayloadLength  uint32
+	PayloadCRC     uint32
+	_              uint32
+}
+
+// ROMIdentity identifies the ROM a save state belongs to
+type ROMIdentity struct {
+	Title          [16]byte
+	GlobalChecksum uint16
+	Checksum       uint32
+}
+
+func IdentifyROM(rom []byte) ROMIdentity {
+	id := ROMIdentity{Checksum: crc32.ChecksumIEEE(rom)}
+	if len(rom) >= 0x150 {
+		copy(id.Title[:], rom[0x134:0x144])
+		id.GlobalChecksum = uint16(rom[0x14E])<<8 | uint16(rom[0x14F])
+	}
+	return id
+}
+
+func (id ROMIdentity) TitleString() string {
+	return string(bytes.TrimRight(id.Title[:], "\x00"))
+}
+
+// Components that are part of a save state. LoadState errors are collected
+// by the StateReader.
+type Snapshotter interface {
+	SaveState(*StateWriter)
+	LoadState(*StateReader)
+}
+
+type StateWriter struct {
+	buffer bytes.Buffer
+}
+
+type StateReader struct {
+	data []byte
+	err  error
+}
+
+func (w *StateWriter) WriteUint8(value uint8) {
+	w.buffer.WriteByte(value)
+}
+
+func (w *StateWriter) WriteBool(value bool) {
+	if value {
+		w.WriteUint8(1)
+	} else {
+		w.WriteUint8(0)
+	}
+}
+
+func (w *StateWriter) WriteUint16(value uint16) {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], value)
+	w.buffer.Write(b[:])
+}
+
+func (w *StateWriter) WriteUint32(value uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], value)
+	w.buffer.Write(b[:])
+}
+
+func (w *StateWriter) WriteUint64(value uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], value)
+	w.buffer.Write(b[:])
+}
+
+// Ints are always stored as 64 bits so states don't depend on the host
+func (w *StateWriter) WriteInt(value int) {
+	w.WriteUint64(uint64(int64(value)))
+}
+
+func (w *StateWriter) WriteBytes(value []byte) {
+	w.buffer.Write(value)
+}
+
+func (w *StateWriter) Bytes() []byte {
+	return w.buffer.Bytes()
+}
+
+// Reset empties the writer but keeps its memory for the next state
+func (w *StateWriter) Reset() {
+	w.buffer.Reset()
+}
+
+// writeSection writes a tagged, length prefixed section
+func (w *StateWriter) writeSection(tag string, s Snapshotter) {
+	section := &StateWriter{}
+	s.SaveState(section)
+	w.WriteBytes([]byte(tag))
+	w.WriteUint32(uint32(section.buffer.Len()))
+	w.WriteBytes(section.Bytes())
+}
+
+func CreateStateReader(data []byte) *StateReader {
+	return &StateReader{data: data}
+}
+
+func (r *StateReader) take(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	if len(r.data) < n {
+		r.err = fmt.Errorf("ERROR save state is truncated")
+		return make([]byte, n)
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *StateReader) ReadUint8() uint8 {
+	return r.take(1)[0]
+}
+
+func (r *StateReader) ReadBool() bool {
+	return r.ReadUint8() != 0
+}
+
+func (r *StateReader) ReadUint16() uint16 {
+	return binary.LittleEndian.Uint16(r.take(2))
+}
+
+func (r *StateReader) ReadUint32() uint32 {
+	return binary.LittleEndian.Uint32(r.take(4))
+}
+
+func (r *StateReader) ReadUint64() uint64 {
+	return binary.LittleEndian.Uint64(r.take(8))
+}
+
+func (r *StateReader) ReadInt() int {
+	return int(int64(r.ReadUint64()))
+}
+
+// ReadBytes fills the given slice
+func (r *StateReader) ReadBytes(value []byte) {
+	copy(value, r.take(len(value)))
+}
+
+// ReadCount reads a length that is expected to be at most max, so a corrupt
+// state can't cause huge allocations
+func (r *StateReader) ReadCount(max int) int {
+	count := r.ReadInt()
+	if count < 0 || count > max {
+		r.Fail(fmt.Errorf("ERROR save state has an invalid length %d (max %d)", count, max))
+		return 0
+	}
+	return count
+}
+
+func (r *StateReader) Fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *StateReader) Remaining() int {
+	return len(r.data)
+}
+
+func (r *StateReader) Err() error {
+	return r.err
+}
+
+func (r *StateReader) readSection(tag string, s Snapshotter) {
+	if found := string(r.take(4)); r.err == nil && found != tag {
+		r.Fail(fmt.Errorf("ERROR save state has section %q where %q was expected", found, tag))
+	}
+	section := CreateStateReader(r.take(int(r.ReadUint32())))
+	if r.err != nil {
+		return
+	}
+	s.LoadState(section)
+	if section.err != nil {
+		r.Fail(fmt.Errorf("ERROR loading save state section %s: %s", tag, section.err))
+	} else if len(section.data) != 0 {
+		r.Fail(fmt.Errorf("ERROR save state section %s has %d unexpected trailing bytes", tag, len(section.data)))
+	}
+}
+
+// WriteSaveState writes the header followed by each component's section
+func WriteSaveState(w io.Writer, rom ROMIdentity, sections []string, components []Snapshotter) error {
+	payload := &StateWriter{}
+	for i := range sections {
+		payload.writeSection(sections[i], components[i])
+	}
+
+	header := saveStateHeader{
+		Version:        SAVE_STATE_VERSION,
+		Title:          rom.Title,
+		GlobalChecksum: rom.GlobalChecksum,
+		ROMChecksum:    rom.Checksum,
+		PayloadLength:  uint32(len(payload.Bytes())),
+		PayloadCRC:     crc32.ChecksumIEEE(payload.Bytes()),
+	}
+	copy(header.Magic[:], SAVE_STATE_MAGIC)
+
+	if err := binary.Write(w, binary.LittleEndian, &header); err != nil {
+		return fmt.Errorf("ERROR writing save state: %s", err)
+	}
+	if _, err := w.Write(payload.Bytes()); err != nil {
+		return fmt.Errorf("ERROR writing save state: %s", err)
+	}
+	return nil
+}
+
+// ReadSaveState validates a save state against the running ROM and returns
+// a reader for its payload. Nothing is loaded until every check has passed.
+func ReadSaveState(r io.Reader, rom ROMIdentity) (*StateReader, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR reading save state: %s", err)
+	}
+	if len(data) < SAVE_STATE_HEADER_SIZE {
+		return nil, fmt.Errorf("ERROR save state is too short to be valid")
+	}
+
+	var header saveStateHeader
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("ERROR reading save state header: %s", err)
+	}
+	if string(header.Magic[:]) != SAVE_STATE_MAGIC {
+		return nil, fmt.Errorf("ERROR not a save state file")
+	}
+	if header.Version != SAVE_STATE_VERSION {
+		return nil, fmt.Errorf("ERROR save state version %d is not supported (expected %d)", header.Version, SAVE_STATE_VERSION)
+	}
+	saved := ROMIdentity{Title: header.Title, GlobalChecksum: header.GlobalChecksum, Checksum: header.ROMChecksum}
+	if saved != rom {
+		return nil, fmt.Errorf("ERROR save state is for a different ROM (%q, CRC %08X) than the one running (%q, CRC %08X)",
+			saved.TitleString(), saved.Checksum, rom.TitleString(), rom.Checksum)
+	}
+
+	payload := data[SAVE_STATE_HEADER_SIZE:]
+	if int(header.PayloadLength) != len(payload) {
+		return nil, fmt.Errorf("ERROR save state payload is %d bytes but the header says %d", len(payload), header.PayloadLength)
+	}
+	if crc32.ChecksumIEEE(payload) != header.PayloadCRC {
+		return nil, fmt.Errorf("ERROR save state is corrupt (checksum mismatch)")
+	}
+	return CreateStateReader(payload), nil
+}
+
+// LoadSections loads each component from its section in order
+func (r *StateReader) LoadSections(sections []string, components []Snapshotter) error {
+	for i := range sections {
+		r.readSection(sections[i], components[i])
+	}
+	if r.err == nil && len(r.data) != 0 {
+		r.Fail(fmt.Errorf("ERROR save state has %d unexpected trailing bytes", len(r.data)))
+	}
+	return r.err
+}
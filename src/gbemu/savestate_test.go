@@ -0,0 +1,103 @@
+package gbemu
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testROM loops incrementing A and storing it to C000
+func testROM(title string) []byte {
+	rom := make([]byte, 0x8000)
+	copy(rom[0x100:], []byte{0x3C, 0xEA, 0x00, 0xC0, 0x18, 0xFA}) // INC A; LD (C000),A; JR -6
+	copy(rom[0x134:], title)
+	return rom
+}
+
+func newTestEmulator(t *testing.T, rom []byte) *Emulator {
+	emulator, err := New(rom, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return emulator
+}
+
+func TestSaveStateRoundTrip(t *testing.T) {
+	emulator := newTestEmulator(t, testROM("TEST"))
+	emulator.RunCycles(10000)
+
+	var state bytes.Buffer
+	if err := emulator.SaveState(&state); err != nil {
+		t.Fatal(err)
+	}
+	registers, counter := emulator.Registers(), emulator.ReadMemory(0xC000)
+
+	emulator.RunCycles(10000)
+	if emulator.Registers() == registers {
+		t.Fatalf("registers didn't change after running on")
+	}
+	if err := emulator.LoadState(bytes.NewReader(state.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if got := emulator.Registers(); got != registers {
+		t.Errorf("registers after loading = %+v, want %+v", got, registers)
+	}
+	if got := emulator.ReadMemory(0xC000); got != counter {
+		t.Errorf("C000 after loading = %02X, want %02X", got, counter)
+	}
+
+	// Saving again straight away gives the same state
+	var again bytes.Buffer
+	if err := emulator.SaveState(&again); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Bytes(), state.Bytes()) {
+		t.Errorf("state saved after loading differs from the one loaded")
+	}
+}
+
+func TestLoadStateRejected(t *testing.T) {
+	source := newTestEmulator(t, testROM("TEST"))
+	source.RunCycles(10000)
+	var state bytes.Buffer
+	if err := source.SaveState(&state); err != nil {
+		t.Fatal(err)
+	}
+	valid := state.Bytes()
+	modified := func(change func([]byte)) []byte {
+		data := append([]byte(nil), valid...)
+		change(data)
+		return data
+	}
+
+	otherROM := testROM("TEST")
+	otherROM[0x200] = 0xFF
+
+	tests := []struct {
+		name string
+		rom  []byte
+		data []byte
+	}{
+		{"bad CRC", testROM("TEST"), modified(func(d []byte) { d[len(d)-1] ^= 0xFF })},
+		{"truncated payload", testROM("TEST"), valid[:len(valid)-1]},
+		{"truncated header", testROM("TEST"), valid[:SAVE_STATE_HEADER_SIZE-1]},
+		{"empty", testROM("TEST"), []byte{}},
+		{"bad magic", testROM("TEST"), modified(func(d []byte) { d[0] = 'X' })},
+		{"wrong version", testROM("TEST"), modified(func(d []byte) { d[8] += 1 })},
+		{"wrong ROM title", testROM("OTHER"), valid},
+		{"wrong ROM contents", otherROM, valid},
+	}
+
+	for _, test := range tests {
+		emulator := newTestEmulator(t, test.rom)
+		emulator.RunCycles(500)
+		registers, counter := emulator.Registers(), emulator.ReadMemory(0xC000)
+
+		if err := emulator.LoadState(bytes.NewReader(test.data)); err == nil {
+			t.Errorf("%s: state loaded without an error", test.name)
+			continue
+		}
+		if emulator.Registers() != registers || emulator.ReadMemory(0xC000) != counter {
+			t.Errorf("%s: emulator changed by a rejected state", test.name)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package gbemu
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Symbol files use the format produced by RGBDS (rgblink -n) and no$gmb:
+//	; comment
+//	00:0150 Main
+//	01:4000 LoadTiles.loop
+// where the first field is the bank and the second the address, both in hex.
+
+type Symbol struct {
+	Bank    int
+	Address uint16
+	Name    string
+}
+
+type SymbolTable interface {
+	Lookup(int, uint16) (string, bool)
+	Symbolize(int, uint16) string
+	Resolve(string) (uint16, bool)
+	Len() int
+}
+
+type symbolTable struct {
+	symbols []Symbol // Sorted by address, then by bank
+	byName  map[string]Symbol
+}
+
+type sortableSymbols []Symbol
+
+func CreateSymbolTable() SymbolTable {
+	return &symbolTable{
+		symbols: make([]Symbol, 0),
+		byName:  make(map[string]Symbol),
+	}
+}
+
+func LoadSymbolFile(filename string) (SymbolTable, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR opening symbol file: %s", err)
+	}
+	defer f.Close()
+	return ParseSymbols(f)
+}
+
+// Symbols are optional. When no symbol file is given, one sitting next to the
+// ROM with the same name is picked up automatically if it exists.
+func InitializeSymbols(romFile, symFile string) (SymbolTable, error) {
+	if symFile == "" {
+		symFile = strings.TrimSuffix(romFile, filepath.Ext(romFile)) + ".sym"
+		if _, err := os.Stat(symFile); err != nil {
+			return nil, nil
+		}
+	}
+
+	symbols, err := LoadSymbolFile(symFile)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Loaded %d symbols from %s\n", symbols.Len(), symFile)
+	return symbols, nil
+}
+
+func ParseSymbols(r io.Reader) (SymbolTable, error) {
+	table := &symbolTable{
+		symbols: make([]Symbol, 0),
+		byName:  make(map[string]Symbol),
+	}
+
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum += 1
+		line := scanner.Text()
+		if idx := strings.Index(line, ";"); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("ERROR parsing symbol file line %d: %q", lineNum, scanner.Text())
+		}
+
+		location := strings.Split(fields[0], ":")
+		if len(location) != 2 {
+			return nil, fmt.Errorf("ERROR parsing symbol file line %d: expected bank:address, got %q", lineNum, fields[0])
+		}
+		bank, err := strconv.ParseUint(location[0], 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("ERROR parsing symbol file line %d: %s", lineNum, err)
+		}
+		addr, err := strconv.ParseUint(location[1], 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("ERROR parsing symbol file line %d: %s", lineNum, err)
+		}
+
+		symbol := Symbol{Bank: int(bank), Address: uint16(addr), Name: fields[1]}
+		table.symbols = append(table.symbols, symbol)
+		if _, found := table.byName[symbol.Name]; !found {
+			table.byName[symbol.Name] = symbol
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ERROR reading symbol file: %s", err)
+	}
+
+	sort.Stable(sortableSymbols(table.symbols))
+	return table, nil
+}
+
+func (t *symbolTable) Len() int {
+	return len(t.symbols)
+}
+
+// Lookup returns the label defined exactly at the given bank and address
+func (t *symbolTable) Lookup(bank int, address uint16) (string, bool) {
+	idx := sort.Search(len(t.symbols), func(i int) bool { return t.symbols[i].Address >= address })
+	for ; idx < len(t.symbols) && t.symbols[idx].Address == address; idx++ {
+		if symbolInBank(t.symbols[idx], bank) {
+			return t.symbols[idx].Name, true
+		}
+	}
+	return "", false
+}
+
+// Symbolize returns the closest preceding label within the same memory region
+// formatted as label+offset, or an empty string if there is none
+func (t *symbolTable) Symbolize(bank int, address uint16) string {
+	idx := sort.Search(len(t.symbols), func(i int) bool { return t.symbols[i].Address > address })
+	for idx -= 1; idx >= 0; idx-- {
+		symbol := t.symbols[idx]
+		if memoryRegionStart(symbol.Address) != memoryRegionStart(address) {
+			break
+		}
+		if !symbolInBank(symbol, bank) {
+			continue
+		}
+		if symbol.Address == address {
+			return symbol.Name
+		}
+		return fmt.Sprintf("%s+%x", symbol.Name, address-symbol.Address)
+	}
+	return ""
+}
+
+// Resolve accepts either a label or label+offset (offset in hex) and returns
+// the address it refers to
+func (t *symbolTable) Resolve(name string) (uint16, bool) {
+	var offset uint64
+	if idx := strings.LastIndex(name, "+"); idx > 0 {
+		var err error
+		offset, err = strconv.ParseUint(strings.TrimPrefix(name[idx+1:], "0x"), 16, 16)
+		if err != nil {
+			return 0, false
+		}
+		name = name[:idx]
+	}
+
+	symbol, found := t.byName[name]
+	if !found {
+		return 0, false
+	}
+	return symbol.Address + uint16(offset), true
+}
+
+// Only the switchable ROM area is banked on the DMG. Labels in every other
+// region are matched regardless of the bank they were declared in.
+func symbolInBank(symbol Symbol, bank int) bool {
+	if symbol.Address < 0x4000 || symbol.Address > 0x7FFF {
+		return true
+	}
+	return symbol.Bank == bank
+}
+
+func memoryRegionStart(address uint16) uint16 {
+	switch {
+	case address <= 0x3FFF:
+		return 0x0000
+	case address <= 0x7FFF:
+		return 0x4000
+	case address <= 0x9FFF:
+		return 0x8000
+	case address <= 0xBFFF:
+		return 0xA000
+	case address <= 0xDFFF:
+		return 0xC000
+	case address <= 0xFDFF:
+		return 0xE000
+	case address <= 0xFEFF:
+		return 0xFE00
+	case address <= 0xFF7F:
+		return 0xFF00
+	default:
+		return 0xFF80
+	}
+}
+
+func (s sortableSymbols) Less(i, j int) bool {
+	if s[i].Address == s[j].Address {
+		return s[i].Bank < s[j].Bank
+	}
+	return s[i].Address < s[j].Address
+}
+
+func (s sortableSymbols) Len() int {
+	return len(s)
+}
+
+func (s sortableSymbols) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
@@ -0,0 +1,105 @@
+package gbemu
+
+import (
+	"strings"
+	"testing"
+)
+
+const TEST_SYMBOLS = `; File generated by rgblink
+00:0150 Main
+00:0158 Main.loop
+01:4000 LoadTiles
+02:4000 PlaySound
+00:C000 wBuffer ; WRAM
+`
+
+func TestParseSymbols(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		count int
+		fails bool
+	}{
+		{"rgbds", TEST_SYMBOLS, 5, false},
+		{"no$gmb", "0000:0150 Main\r\n0001:4000 LoadTiles\r\n", 2, false},
+		{"blank lines and comments", "\n; comment\n   \n00:0150 Main\n", 1, false},
+		{"missing name", "00:0150\n", 0, true},
+		{"missing bank", "0150 Main\n", 0, true},
+		{"bad address", "00:XYZ Main\n", 0, true},
+	}
+
+	for _, test := range tests {
+		table, err := ParseSymbols(strings.NewReader(test.input))
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if table.Len() != test.count {
+			t.Errorf("%s: parsed %d symbols, want %d", test.name, table.Len(), test.count)
+		}
+	}
+}
+
+func TestSymbolize(t *testing.T) {
+	table, err := ParseSymbols(strings.NewReader(TEST_SYMBOLS))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		bank    int
+		address uint16
+		want    string
+	}{
+		{0, 0x0150, "Main"},
+		{0, 0x0152, "Main+2"},
+		{0, 0x015A, "Main.loop+2"},
+		{1, 0x4010, "LoadTiles+10"},
+		{2, 0x4010, "PlaySound+10"},
+		{3, 0x4010, ""},
+		{5, 0xC004, "wBuffer+4"},
+		{0, 0x0100, ""},
+		{0, 0x8000, ""}, // Labels don't carry over into the next region
+	}
+
+	for _, test := range tests {
+		if got := table.Symbolize(test.bank, test.address); got != test.want {
+			t.Errorf("Symbolize(%d, %04X) = %q, want %q", test.bank, test.address, got, test.want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	table, err := ParseSymbols(strings.NewReader(TEST_SYMBOLS))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		address uint16
+		found   bool
+	}{
+		{"Main", 0x0150, true},
+		{"Main.loop", 0x0158, true},
+		{"Main+10", 0x0160, true},
+		{"Main+0x10", 0x0160, true},
+		{"LoadTiles+ff", 0x40FF, true},
+		{"Main+zz", 0, false},
+		{"Missing", 0, false},
+		{"Missing+1", 0, false},
+	}
+
+	for _, test := range tests {
+		address, found := table.Resolve(test.name)
+		if found != test.found || address != test.address {
+			t.Errorf("Resolve(%q) = %04X, %v, want %04X, %v", test.name, address, found, test.address, test.found)
+		}
+	}
+}
@@ -1,7 +1,8 @@
-package main
+package gbemu
 
 type Timer interface {
 	Tick()
+	Snapshotter
 }
 
 type timer struct {
@@ -42,25 +43,25 @@ func (t *timer) Tick() {
 }
 
 func (t *timer) incrementDividerRegister() {
-	t.mmu.WriteByte(DIVIDER_REGISTER, t.mmu.ReadAt(DIVIDER_REGISTER)+1)
+	t.mmu.WriteIORegister(DIVIDER_REGISTER, t.mmu.ReadIORegister(DIVIDER_REGISTER)+1)
 }
 
 func (t *timer) incrementTimerRegister() {
-	currentValue := t.mmu.ReadAt(TIMER_REGISTER)
+	currentValue := t.mmu.ReadIORegister(TIMER_REGISTER)
 	if currentValue == 0xFF {
-		t.mmu.WriteByte(TIMER_REGISTER, t.mmu.ReadAt(TIMER_MODULO))
+		t.mmu.WriteIORegister(TIMER_REGISTER, t.mmu.ReadIORegister(TIMER_MODULO))
 		t.mmu.FireInterrupt(TIMER_INTERRUPT)
 	} else {
-		t.mmu.WriteByte(TIMER_REGISTER, currentValue+1)
+		t.mmu.WriteIORegister(TIMER_REGISTER, currentValue+1)
 	}
 }
 
 func (t *timer) timerEnabled() bool {
-	return GetBit(t.mmu.ReadAt(TIMER_CONTROL), 2) == 1
+	return GetBit(t.mmu.ReadIORegister(TIMER_CONTROL), 2) == 1
 }
 
 func getInputClock(mmu MMU) int {
-	value := mmu.ReadAt(TIMER_CONTROL)
+	value := mmu.ReadIORegister(TIMER_CONTROL)
 	switch value {
 	case 0:
 		return 1024
@@ -72,3 +73,15 @@ func getInputClock(mmu MMU) int {
 		return 256
 	}
 }
+
+func (t *timer) SaveState(w *StateWriter) {
+	w.WriteInt(t.dividerCounter)
+	w.WriteInt(t.timerCounter)
+	w.WriteInt(t.currentInputClock)
+}
+
+func (t *timer) LoadState(r *StateReader) {
+	t.dividerCounter = r.ReadInt()
+	t.timerCounter = r.ReadInt()
+	t.currentInputClock = r.ReadInt()
+}
@@ -0,0 +1,144 @@
+package gbemu
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Traces are written in the Gameboy Doctor format, one line per executed
+// instruction with the CPU state as it was before the instruction ran:
+//	A:01 F:B0 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0100 PCMEM:00,C3,13,02
+
+type Tracer interface {
+	Trace(Registers, int)
+	Dump()
+	Close() error
+}
+
+type TraceOptions struct {
+	Filename string
+	StartPC  uint16      // First PC (inclusive) that will be logged
+	EndPC    uint16      // Last PC (inclusive) that will be logged
+	Bank     int         // Only log instructions in this ROM bank, -1 for any bank
+	RingSize int         // When > 0 only the last RingSize instructions are kept and written on Dump
+	Symbols  SymbolTable // When set each line is annotated with label+offset
+}
+
+type traceEntry struct {
+	registers [8]uint8
+	sp        uint16
+	pc        uint16
+	bank      int
+	pcmem     [4]uint8
+}
+
+type tracer struct {
+	mmu     MMU
+	options TraceOptions
+	file    *os.File
+	writer  *bufio.Writer
+	ring    []traceEntry
+	ringPos int
+	ringLen int
+	lock    sync.Mutex
+}
+
+var traceRegisterOrder = []Register{a, f, b, c, d, e, h, l}
+
+func CreateTracer(mmu MMU, options TraceOptions) (Tracer, error) {
+	file, err := os.Create(options.Filename)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR creating trace file: %s", err)
+	}
+
+	t := &tracer{
+		mmu:     mmu,
+		options: options,
+		file:    file,
+		writer:  bufio.NewWriterSize(file, 1<<20),
+	}
+	if options.RingSize > 0 {
+		t.ring = make([]traceEntry, options.RingSize)
+	}
+	return t, nil
+}
+
+func (t *tracer) Trace(regs Registers, bank int) {
+	pc := regs.ReadPC()
+	if pc < t.options.StartPC || pc > t.options.EndPC {
+		return
+	}
+	if t.options.Bank >= 0 && pc >= 0x4000 && pc <= 0x7FFF && bank != t.options.Bank {
+		return
+	}
+
+	entry := traceEntry{sp: regs.ReadSP(), pc: pc, bank: bank}
+	for i, reg := range traceRegisterOrder {
+		entry.registers[i] = regs.ReadRegister(reg)
+	}
+	for i := range entry.pcmem {
+		entry.pcmem[i] = t.mmu.PeekAt(pc + uint16(i))
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.ring != nil {
+		t.ring[t.ringPos] = entry
+		t.ringPos = (t.ringPos + 1) % len(t.ring)
+		if t.ringLen < len(t.ring) {
+			t.ringLen += 1
+		}
+		return
+	}
+	t.writeEntry(t.writer, entry)
+}
+
+// Dump is called when the emulator crashes. In ring buffer mode it writes out
+// the last instructions that were executed, otherwise it just flushes the log.
+func (t *tracer) Dump() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.ring != nil {
+		start := t.ringPos - t.ringLen
+		if start < 0 {
+			start += len(t.ring)
+		}
+		for i := 0; i < t.ringLen; i++ {
+			t.writeEntry(t.writer, t.ring[(start+i)%len(t.ring)])
+		}
+		t.ringLen = 0
+	}
+
+	if err := t.writer.Flush(); err != nil {
+		fmt.Printf("ERROR writing trace file: %s\n", err)
+	}
+}
+
+func (t *tracer) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// Ring buffer traces are only written when something goes wrong
+	if err := t.writer.Flush(); err != nil {
+		t.file.Close()
+		return err
+	}
+	return t.file.Close()
+}
+
+func (t *tracer) writeEntry(w io.Writer, entry traceEntry) {
+	r := entry.registers
+	fmt.Fprintf(w, "A:%02X F:%02X B:%02X C:%02X D:%02X E:%02X H:%02X L:%02X SP:%04X PC:%04X PCMEM:%02X,%02X,%02X,%02X",
+		r[0], r[1], r[2], r[3], r[4], r[5], r[6], r[7], entry.sp, entry.pc,
+		entry.pcmem[0], entry.pcmem[1], entry.pcmem[2], entry.pcmem[3])
+	if t.options.Symbols != nil {
+		if label := t.options.Symbols.Symbolize(entry.bank, entry.pc); label != "" {
+			fmt.Fprintf(w, " ; %s", label)
+		}
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,280 @@
+package gbemu
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tracediff streams two trace logs (e.g. our own against one produced by a
+// known-good emulator) and reports the first line where they diverge. Lines
+// are compared field by field ("A:01 F:B0 ... PC:0100") so logs with extra
+// fields or a different field order still line up. Only a small window of
+// previous lines is kept in memory, so arbitrarily large logs can be compared.
+
+type traceLine struct {
+	number int
+	text   string
+	fields map[string]string
+	order  []string
+}
+
+type traceReader struct {
+	name    string
+	file    *os.File
+	scanner *bufio.Scanner
+	line    int
+	history []traceLine // Ring buffer of the previous lines for context
+	next    int
+	done    bool
+}
+
+func RunTraceDiff(args []string) int {
+	flags := flag.NewFlagSet("tracediff", flag.ExitOnError)
+	ignore := flags.String("ignore", "", "comma separated list of fields to ignore (e.g. LY,PCMEM)")
+	context := flags.Int("context", 5, "number of lines of context to show around the divergence")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: gbemu tracediff [options] <trace> <reference trace>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	if *context < 0 {
+		fmt.Fprintln(flags.Output(), "ERROR -context can't be negative")
+		flags.Usage()
+		return 2
+	}
+
+	ignored := make(map[string]bool)
+	for _, field := range strings.Split(*ignore, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			ignored[strings.ToUpper(field)] = true
+		}
+	}
+
+	left, err := openTrace(flags.Arg(0), *context)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	defer left.file.Close()
+	right, err := openTrace(flags.Arg(1), *context)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	defer right.file.Close()
+
+	leftLine, rightLine, mismatched, err := firstDivergence(left, right, ignored)
+	switch {
+	case err != nil:
+		fmt.Println(err)
+		return 2
+	case len(mismatched) > 0:
+		reportDivergence(left, right, leftLine, rightLine, mismatched, *context)
+		return 1
+	case left.done != right.done:
+		shorter, longer := left, right
+		if right.done {
+			shorter, longer = right, left
+		}
+		fmt.Printf("%s ended after %d lines but %s continues\n", shorter.name, shorter.line, longer.name)
+		return 1
+	}
+	fmt.Printf("Traces match (%d lines)\n", left.line)
+	return 0
+}
+
+// firstDivergence reads both traces in step until a pair of lines differs and
+// returns the fields that don't match. When either trace runs out first no
+// fields are returned and the reader that ended is marked done.
+func firstDivergence(left, right *traceReader, ignored map[string]bool) (traceLine, traceLine, []string, error) {
+	for {
+		leftLine, leftOk := left.read()
+		rightLine, rightOk := right.read()
+
+		if !leftOk || !rightOk {
+			if err := firstError(left.scanner.Err(), right.scanner.Err()); err != nil {
+				return traceLine{}, traceLine{}, nil, fmt.Errorf("ERROR reading trace: %s", err)
+			}
+			return leftLine, rightLine, nil, nil
+		}
+
+		if mismatched := compareTraceLines(leftLine, rightLine, ignored); len(mismatched) > 0 {
+			return leftLine, rightLine, mismatched, nil
+		}
+		left.remember(leftLine)
+		right.remember(rightLine)
+	}
+}
+
+func openTrace(filename string, context int) (*traceReader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR opening trace: %s", err)
+	}
+	reader := createTraceReader(filename, file, context)
+	reader.file = file
+	return reader, nil
+}
+
+func createTraceReader(name string, r io.Reader, context int) *traceReader {
+	return &traceReader{
+		name:    name,
+		scanner: bufio.NewScanner(bufio.NewReaderSize(r, 1<<20)),
+		history: make([]traceLine, context),
+	}
+}
+
+// read returns the next non-empty line of the trace
+func (r *traceReader) read() (traceLine, bool) {
+	for r.scanner.Scan() {
+		r.line += 1
+		text := r.scanner.Text()
+		if idx := strings.Index(text, ";"); idx >= 0 { // Strip label annotations
+			text = text[:idx]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		return parseTraceLine(r.line, text), true
+	}
+	r.done = true
+	return traceLine{}, false
+}
+
+func (r *traceReader) remember(line traceLine) {
+	if len(r.history) == 0 {
+		return
+	}
+	r.history[r.next] = line
+	r.next = (r.next + 1) % len(r.history)
+}
+
+// previous returns the remembered lines, oldest first
+func (r *traceReader) previous() []traceLine {
+	lines := make([]traceLine, 0, len(r.history))
+	for i := 0; i < len(r.history); i++ {
+		line := r.history[(r.next+i)%len(r.history)]
+		if line.number != 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func parseTraceLine(number int, text string) traceLine {
+	line := traceLine{number: number, text: text, fields: make(map[string]string)}
+	for _, token := range strings.Fields(text) {
+		idx := strings.Index(token, ":")
+		if idx <= 0 {
+			continue
+		}
+		key := strings.ToUpper(token[:idx])
+		line.fields[key] = strings.ToUpper(token[idx+1:])
+		line.order = append(line.order, key)
+	}
+	return line
+}
+
+// compareTraceLines returns the names of the fields that are present in both
+// lines but have different values
+func compareTraceLines(left, right traceLine, ignored map[string]bool) []string {
+	mismatched := []string{}
+	for _, key := range left.order {
+		if ignored[key] {
+			continue
+		}
+		if value, found := right.fields[key]; found && value != left.fields[key] {
+			mismatched = append(mismatched, key)
+		}
+	}
+	return mismatched
+}
+
+func reportDivergence(left, right *traceReader, leftLine, rightLine traceLine, mismatched []string, context int) {
+	fmt.Printf("First divergence at %s:%d / %s:%d\n", left.name, leftLine.number, right.name, rightLine.number)
+	for _, key := range mismatched {
+		fmt.Printf("  %-6s %s != %s\n", key, leftLine.fields[key], rightLine.fields[key])
+	}
+	// The divergence is usually caused by the instruction executed just before it
+	leftPrevious, rightPrevious := left.previous(), right.previous()
+	if len(leftPrevious) > 0 {
+		if instruction, ok := decodeTraceInstruction(leftPrevious[len(leftPrevious)-1]); ok {
+			fmt.Printf("Previous instruction: %s\n", instruction)
+		}
+	}
+	if instruction, ok := decodeTraceInstruction(leftLine); ok {
+		fmt.Printf("Instruction:          %s\n", instruction)
+	}
+
+	fmt.Println()
+	for i := range leftPrevious {
+		fmt.Printf("   %s\n", leftPrevious[i].text)
+		if i < len(rightPrevious) && rightPrevious[i].text != leftPrevious[i].text {
+			fmt.Printf("   %s\n", rightPrevious[i].text)
+		}
+	}
+	fmt.Printf("-  %s\n", leftLine.text)
+	fmt.Printf("+  %s\n", rightLine.text)
+
+	for i := 0; i < context; i++ {
+		leftNext, leftOk := left.read()
+		rightNext, rightOk := right.read()
+		if leftOk {
+			fmt.Printf("-  %s\n", leftNext.text)
+		}
+		if rightOk {
+			fmt.Printf("+  %s\n", rightNext.text)
+		}
+	}
+}
+
+// The instruction is decoded from the PCMEM bytes recorded in the trace line
+// since the ROM itself is not available
+func decodeTraceInstruction(line traceLine) (DisassembledInstruction, bool) {
+	pcValue, pcFound := line.fields["PC"]
+	memValue, memFound := line.fields["PCMEM"]
+	if !pcFound || !memFound {
+		return DisassembledInstruction{}, false
+	}
+
+	pc, err := strconv.ParseUint(pcValue, 16, 16)
+	if err != nil {
+		return DisassembledInstruction{}, false
+	}
+	bytes := []uint8{}
+	for _, value := range strings.Split(memValue, ",") {
+		b, err := strconv.ParseUint(value, 16, 8)
+		if err != nil {
+			return DisassembledInstruction{}, false
+		}
+		bytes = append(bytes, uint8(b))
+	}
+
+	read := func(addr uint16) uint8 {
+		if offset := int(addr - uint16(pc)); offset < len(bytes) {
+			return bytes[offset]
+		}
+		return 0
+	}
+	return Disassemble(read, uint16(pc), 0, nil), true
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
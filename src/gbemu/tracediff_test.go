@@ -0,0 +1,111 @@
+package gbemu
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFirstDivergence(t *testing.T) {
+	tests := []struct {
+		name       string
+		left       string
+		right      string
+		ignored    string
+		line       int // Line of the first divergence in the left trace, 0 if none
+		mismatched string
+		leftDone   bool
+		rightDone  bool
+	}{
+		{
+			"identical",
+			"A:01 PC:0100\nA:02 PC:0101\n",
+			"A:01 PC:0100\nA:02 PC:0101\n",
+			"", 0, "", true, true,
+		},
+		{
+			"register differs",
+			"A:01 PC:0100\nA:02 PC:0101\nA:03 PC:0102\n",
+			"A:01 PC:0100\nA:02 PC:0101\nA:04 PC:0102\n",
+			"", 3, "A", false, false,
+		},
+		{
+			"several fields differ",
+			"A:01 F:B0 PC:0100\n",
+			"A:02 F:80 PC:0100\n",
+			"", 1, "A,F", false, false,
+		},
+		{
+			"ignored field",
+			"A:01 LY:00 PC:0100\nA:02 LY:01 PC:0101\n",
+			"A:01 LY:90 PC:0100\nA:02 LY:91 PC:0101\n",
+			"LY", 0, "", true, true,
+		},
+		{
+			"field order and extra fields",
+			"A:01 B:00 PC:0100\n",
+			"PC:0100 A:01 PCMEM:00,00,00,00\n",
+			"", 0, "", true, true,
+		},
+		{
+			"case and label annotations",
+			"A:0a PC:0150 ; Main\n",
+			"A:0A PC:0150\n",
+			"", 0, "", true, true,
+		},
+		{
+			"blank lines",
+			"A:01 PC:0100\n\nA:02 PC:0101\n",
+			"A:01 PC:0100\nA:03 PC:0101\n",
+			"", 3, "A", false, false,
+		},
+		{
+			"left ends first",
+			"A:01 PC:0100\n",
+			"A:01 PC:0100\nA:02 PC:0101\n",
+			"", 0, "", true, false,
+		},
+		{
+			"right ends first",
+			"A:01 PC:0100\nA:02 PC:0101\n",
+			"A:01 PC:0100\n",
+			"", 0, "", false, true,
+		},
+	}
+
+	for _, test := range tests {
+		left := createTraceReader("left", strings.NewReader(test.left), 2)
+		right := createTraceReader("right", strings.NewReader(test.right), 2)
+		ignored := map[string]bool{}
+		if test.ignored != "" {
+			ignored[test.ignored] = true
+		}
+
+		leftLine, _, mismatched, err := firstDivergence(left, right, ignored)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if got := strings.Join(mismatched, ","); got != test.mismatched {
+			t.Errorf("%s: mismatched fields = %q, want %q", test.name, got, test.mismatched)
+		}
+		if test.line != 0 && leftLine.number != test.line {
+			t.Errorf("%s: diverged at line %d, want %d", test.name, leftLine.number, test.line)
+		}
+		if left.done != test.leftDone || right.done != test.rightDone {
+			t.Errorf("%s: done = %v/%v, want %v/%v", test.name, left.done, right.done, test.leftDone, test.rightDone)
+		}
+	}
+}
+
+func TestTraceHistory(t *testing.T) {
+	left := createTraceReader("left", strings.NewReader("PC:0100\nPC:0101\nPC:0102\nPC:0103\nA:01 PC:0104\n"), 2)
+	right := createTraceReader("right", strings.NewReader("PC:0100\nPC:0101\nPC:0102\nPC:0103\nA:02 PC:0104\n"), 2)
+	if _, _, mismatched, _ := firstDivergence(left, right, map[string]bool{}); len(mismatched) == 0 {
+		t.Fatalf("traces didn't diverge")
+	}
+
+	previous := left.previous()
+	if len(previous) != 2 || previous[0].text != "PC:0102" || previous[1].text != "PC:0103" {
+		t.Errorf("context before the divergence = %v, want the lines at 0102 and 0103", previous)
+	}
+}
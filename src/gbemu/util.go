@@ -1,4 +1,4 @@
-package main
+package gbemu
 
 func GetBit(value uint8, bit uint) int {
 	return int((value >> bit) & 1)